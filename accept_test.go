@@ -0,0 +1,51 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNextRetryDelay(t *testing.T) {
+	var delay time.Duration
+	var got []time.Duration
+	for range 10 {
+		delay = nextRetryDelay(delay)
+		got = append(got, delay)
+	}
+
+	want := []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+		80 * time.Millisecond, 160 * time.Millisecond, 320 * time.Millisecond, 640 * time.Millisecond,
+		time.Second, time.Second,
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got delays %v, want %v", got, want)
+		}
+	}
+}
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "temporary failure" }
+func (temporaryErr) Temporary() bool { return true }
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: temporaryErr{}, want: true},
+		{err: fmt.Errorf("accept: %w", temporaryErr{}), want: true},
+		{err: errors.New("fatal"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isTemporary(tt.err); got != tt.want {
+			t.Errorf("isTemporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// activityConn closes idle connections by extending the deadlines of both directions on every read and write,
+// so the connection times out once there has been no activity for the ActivityTimeout.
+// The deadlines set through it, such as the ReadTimeout, still apply when they are earlier.
+type activityConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mux           sync.Mutex
+	activity      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	if err := c.bump(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(p)
+	return n, c.timeoutError(err, &c.readDeadline)
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	if err := c.bump(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Write(p)
+	return n, c.timeoutError(err, &c.writeDeadline)
+}
+
+func (c *activityConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *activityConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.earliest(t))
+}
+
+func (c *activityConn) SetWriteDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(c.earliest(t))
+}
+
+// bump extends the activity deadline of both directions.
+func (c *activityConn) bump() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.activity = time.Now().Add(c.timeout)
+	if err := c.Conn.SetReadDeadline(c.earliest(c.readDeadline)); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(c.earliest(c.writeDeadline))
+}
+
+// earliest returns the deadline t if set and earlier than the activity deadline, or the activity deadline otherwise.
+func (c *activityConn) earliest(t time.Time) time.Time {
+	if !t.IsZero() && t.Before(c.activity) {
+		return t
+	}
+
+	return c.activity
+}
+
+// timeoutError wraps err with ErrActivityTimeout if it was caused by the activity deadline
+// rather than by the given deadline set through the connection.
+func (c *activityConn) timeoutError(err error, deadline *time.Time) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.earliest(*deadline).Equal(*deadline) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrActivityTimeout, err)
+}
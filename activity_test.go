@@ -0,0 +1,39 @@
+package tcpserver_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestActivityTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		ActivityTimeout: timeout,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	// Intermittent activity keeps the connection alive for longer than the timeout.
+	conn := dial(t, addr)
+	start := time.Now()
+	for time.Since(start) < 2*timeout {
+		if got := conn.roundTrip("ping"); got != "ping" {
+			t.Fatalf("got %q, want %q", got, "ping")
+		}
+
+		time.Sleep(timeout / 4)
+	}
+
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, tcpserver.ErrActivityTimeout) {
+		t.Errorf("got disconnect error %v, want %v", err, tcpserver.ErrActivityTimeout)
+	}
+}
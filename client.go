@@ -0,0 +1,175 @@
+package tcpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientConfig is the configuration of a Client. If a field is not set, a default value is used.
+type ClientConfig struct {
+	// Network to dial. By default, it dials "tcp".
+	Network string
+
+	// Encoder used to encode messages sent to the server.
+	// It must match the server Decoder. If nil, it writes the message as is.
+	Encoder Encoder
+
+	// Decoder used to decode responses from the server.
+	// It must match the server Encoder. If nil, it uses a new line decoder.
+	Decoder Decoder
+
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+
+	// Compression compresses the stream in both directions. It must match the server Compression.
+	Compression Compression
+}
+
+// Client is a connection to a Server that sends messages and reads their responses
+// using the same codec as the server.
+// It is safe for concurrent use; concurrent calls to Send are serialized.
+type Client struct {
+	mux        sync.Mutex
+	conn       net.Conn
+	counter    *readCounter
+	reader     *bufio.Reader
+	compressor compressWriter
+	encoder    Encoder
+	decoder    Decoder
+}
+
+// Dial connects to the server at address with the given config.
+func Dial(address string, config ...ClientConfig) (*Client, error) {
+	return DialContext(context.Background(), address, config...)
+}
+
+// DialContext connects to the server at address with the given config.
+// If ctx is done before the connection is established, it returns the context's error.
+func DialContext(ctx context.Context, address string, config ...ClientConfig) (*Client, error) {
+	var cfg ClientConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	if cfg.Encoder == nil {
+		cfg.Encoder = &newLineEncodeDecoder{}
+	}
+
+	if cfg.Decoder == nil {
+		cfg.Decoder = &newLineEncodeDecoder{}
+	}
+
+	var conn net.Conn
+	var err error
+	if cfg.TLSConfig != nil {
+		dialer := &tls.Dialer{Config: cfg.TLSConfig}
+		conn, err = dialer.DialContext(ctx, cfg.Network, address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, cfg.Network, address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &readCounter{r: conn}
+	return &Client{
+		conn:       conn,
+		counter:    counter,
+		reader:     bufio.NewReader(cfg.Compression.newReader(counter)),
+		compressor: cfg.Compression.newWriter(conn),
+		encoder:    cfg.Encoder,
+		decoder:    cfg.Decoder,
+	}, nil
+}
+
+// Send encodes msg to the server and returns the decoded response.
+func (c *Client) Send(msg []byte) ([]byte, error) {
+	return c.SendContext(context.Background(), msg)
+}
+
+// SendContext is like Send, but bounds the exchange with the deadline of ctx, if any,
+// and interrupts it as soon as ctx is canceled, in which case it returns the context's error.
+// Once interrupted, a response may be left unread, so the Client should be closed.
+func (c *Client) SendContext(ctx context.Context, msg []byte) (response []byte, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if ctx.Done() != nil {
+		deadline, _ := ctx.Deadline()
+		if err := c.conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		stop := context.AfterFunc(ctx, func() {
+			_ = c.conn.SetDeadline(time.Now())
+		})
+		defer func() {
+			stop()
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			_ = c.conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	var w io.Writer = c.conn
+	if c.compressor != nil {
+		w = c.compressor
+	}
+
+	if err := c.encoder.Encode(w, msg); err != nil {
+		return nil, err
+	}
+
+	if c.compressor != nil {
+		if err := c.compressor.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.decoder.Decode(c.reader)
+}
+
+// received returns the number of bytes read from the connection so far.
+func (c *Client) received() int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.counter.n
+}
+
+// Close closes the connection to the server, ending the compressed stream first if any.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.compressor != nil {
+		_ = c.compressor.Close()
+	}
+
+	return c.conn.Close()
+}
+
+// readCounter counts the bytes read from r.
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,72 @@
+package tcpserver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// dialClient connects a Client to addr. The client is closed when the test finishes.
+func dialClient(t *testing.T, addr string, config ...tcpserver.ClientConfig) *tcpserver.Client {
+	t.Helper()
+
+	client, err := tcpserver.Dial(addr, config...)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestClient(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{})
+
+	client := dialClient(t, addr)
+	for _, message := range []string{"hello\n", "world\n"} {
+		response, err := client.Send([]byte(message))
+		if err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		if string(response) != message {
+			t.Errorf("got %q, want %q", response, message)
+		}
+	}
+}
+
+func TestClientWithCodec(t *testing.T) {
+	codec := &tcpserver.LengthPrefix{PrefixSize: 2}
+	_, addr := startServer(t, tcpserver.Config{Decoder: codec, Encoder: codec})
+
+	client := dialClient(t, addr, tcpserver.ClientConfig{Encoder: codec, Decoder: codec})
+	response, err := client.Send([]byte("with\nnew lines"))
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if string(response) != "with\nnew lines" {
+		t.Errorf("got %q, want %q", response, "with\nnew lines")
+	}
+}
+
+func TestClientSendContextDeadline(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			time.Sleep(200 * time.Millisecond)
+			return message, nil
+		},
+	})
+
+	client := dialClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.SendContext(ctx, []byte("hello\n")); !errors.Is(err, context.DeadlineExceeded) && !isTimeout(err) {
+		t.Errorf("got error %v, want a deadline error", err)
+	}
+}
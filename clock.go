@@ -0,0 +1,43 @@
+package tcpserver
+
+import "time"
+
+// clock abstracts the passage of time so that the timeouts owned by the server, such as the IdleTimeout,
+// the WriteBatchWindow and the accept retry delay, can be tested deterministically.
+// Socket deadlines and context deadlines are enforced on the wall clock, so they are always based on time.Now.
+// The server uses realClock unless a test replaces it.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is the subset of *time.Timer used by the server.
+// C returns nil for timers created with AfterFunc.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
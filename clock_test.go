@@ -0,0 +1,228 @@
+package tcpserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when Advance is called.
+// Timers fire synchronously in Advance once their deadline is reached.
+type fakeClock struct {
+	mux    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+
+	// changed is closed and replaced whenever a timer is created.
+	changed chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), changed: make(chan struct{})}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.addTimer(d, make(chan time.Time, 1), nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.addTimer(d, nil, f)
+}
+
+func (c *fakeClock) addTimer(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: ch, f: f, active: true}
+	c.timers = append(c.timers, t)
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	return t
+}
+
+// Advance moves the time forward by d and fires the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*fakeTimer
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case !t.active:
+		case !t.when.After(c.now):
+			t.active = false
+			due = append(due, t)
+		default:
+			active = append(active, t)
+		}
+	}
+
+	c.timers = active
+	now := c.now
+	c.mux.Unlock()
+
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+		} else {
+			t.c <- now
+		}
+	}
+}
+
+// waitTimers blocks until n timers are active, failing the test if it takes longer than a few seconds
+// of real time, which only happens if the server is broken.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		c.mux.Lock()
+		var active int
+		for _, timer := range c.timers {
+			if timer.active {
+				active++
+			}
+		}
+		changed := c.changed
+		c.mux.Unlock()
+
+		if active >= n {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("got %d active timers, want %d", active, n)
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	c      chan time.Time
+	f      func()
+	active bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func TestIdleTimeoutWithFakeClock(t *testing.T) {
+	const idleTimeout = time.Minute
+
+	disconnected := make(chan error, 1)
+	server := New(Config{
+		IdleTimeout:         idleTimeout,
+		AllowDefaultHandler: true,
+		Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ListenerAddrFunc:    NoopListenerAddrFunc,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	clock := newFakeClock()
+	server.clock = clock
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addr, err := server.WaitAddr(ctx)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	roundTrip := func(message string) {
+		t.Helper()
+
+		if _, err := io.WriteString(conn, message); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		response, err := reader.ReadString('\n')
+		if err != nil || response != message {
+			t.Fatalf("got response %q and error %v, want %q", response, err, message)
+		}
+	}
+
+	roundTrip("hello\n")
+
+	// Just before the timeout, the connection is still served and the idle timer restarts.
+	clock.waitTimers(t, 1)
+	clock.Advance(idleTimeout - time.Second)
+	roundTrip("still there\n")
+
+	clock.waitTimers(t, 1)
+	select {
+	case err := <-disconnected:
+		t.Fatalf("disconnected before the idle timeout elapsed: %v", err)
+	default:
+	}
+
+	clock.Advance(idleTimeout)
+
+	select {
+	case err := <-disconnected:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("got disconnect error %v, want %v", err, ErrIdleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed once the idle timeout elapsed")
+	}
+
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("got read error %v, want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,77 @@
+package tcpserver
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+)
+
+// Compression is the algorithm used to compress the stream of a connection in both directions.
+// Both endpoints must agree on it out of band.
+type Compression int
+
+const (
+	// CompressionNone disables compression.
+	CompressionNone Compression = iota
+
+	// CompressionGzip compresses the stream with gzip.
+	CompressionGzip
+
+	// CompressionZlib compresses the stream with zlib.
+	CompressionZlib
+)
+
+// compressWriter is a compressing writer. Written data may stay in its buffer until Flush is called.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newWriter returns a writer compressing to w, or nil if compression is disabled.
+func (c Compression) newWriter(w io.Writer) compressWriter {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w)
+	case CompressionZlib:
+		return zlib.NewWriter(w)
+	default:
+		return nil
+	}
+}
+
+// newReader returns a reader decompressing from r, or r itself if compression is disabled.
+func (c Compression) newReader(r io.Reader) io.Reader {
+	switch c {
+	case CompressionGzip:
+		return &lazyReader{r: r, open: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}}
+	case CompressionZlib:
+		return &lazyReader{r: r, open: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		}}
+	default:
+		return r
+	}
+}
+
+// lazyReader opens the decompressing reader on the first Read,
+// since opening it blocks until the header is received.
+type lazyReader struct {
+	r    io.Reader
+	open func(r io.Reader) (io.Reader, error)
+	dec  io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.dec == nil {
+		dec, err := l.open(l.r)
+		if err != nil {
+			return 0, err
+		}
+
+		l.dec = dec
+	}
+
+	return l.dec.Read(p)
+}
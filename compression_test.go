@@ -0,0 +1,65 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	compressions := map[string]tcpserver.Compression{
+		"gzip": tcpserver.CompressionGzip,
+		"zlib": tcpserver.CompressionZlib,
+	}
+
+	for name, compression := range compressions {
+		t.Run(name, func(t *testing.T) {
+			_, addr := startServer(t, tcpserver.Config{Compression: compression})
+
+			client := dialClient(t, addr, tcpserver.ClientConfig{Compression: compression})
+			for _, message := range []string{"hello\n", strings.Repeat("compressible ", 1000) + "\n"} {
+				response, err := client.Send([]byte(message))
+				if err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+
+				if string(response) != message {
+					t.Errorf("got a response of %d bytes, want %d", len(response), len(message))
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionIsOnTheWire(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Compression: tcpserver.CompressionGzip})
+
+	conn := dial(t, addr)
+	zw := gzip.NewWriter(conn)
+	message := strings.Repeat("a", 10000) + "\n"
+	if _, err := io.WriteString(zw, message); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	if err := zw.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	zr, err := gzip.NewReader(conn.reader)
+	if err != nil {
+		t.Fatalf("the response is not gzip compressed: %v", err)
+	}
+
+	response := make([]byte, len(message))
+	if _, err := io.ReadFull(zr, response); err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+
+	if !bytes.Equal(response, []byte(message)) {
+		t.Error("got a response that differs from the message")
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !plan9
+
+package tcpserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenConn reports whether err is a broken pipe or a connection reset by the peer.
+func isBrokenConn(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// wsaeAddrInUse is the error returned by Windows when an address is already in use,
+// which is not the same Errno as syscall.EADDRINUSE there.
+const wsaeAddrInUse = syscall.Errno(10048)
+
+// isAddrInUse reports whether err means the address is already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, wsaeAddrInUse)
+}
+
+// isFDExhausted reports whether err means the process or the system ran out of file descriptors.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
@@ -0,0 +1,20 @@
+package tcpserver
+
+import "strings"
+
+// isBrokenConn reports whether err is a broken pipe or a connection reset by the peer.
+// Plan 9 reports them as plain strings, so they are not recognized.
+func isBrokenConn(err error) bool {
+	return false
+}
+
+// isAddrInUse reports whether err means the address is already in use.
+// Plan 9 reports it as a plain string, so it is matched by its text.
+func isAddrInUse(err error) bool {
+	return strings.Contains(err.Error(), "address in use")
+}
+
+// isFDExhausted reports whether err means the process or the system ran out of file descriptors.
+func isFDExhausted(err error) bool {
+	return false
+}
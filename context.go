@@ -0,0 +1,82 @@
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+)
+
+type (
+	remoteAddrKey    struct{}
+	connIDKey        struct{}
+	correlationIDKey struct{}
+	tlsStateKey      struct{}
+	countingConnKey  struct{}
+	sessionKey       struct{}
+)
+
+// RemoteAddr returns the remote address of the connection that sent the message being handled.
+// It returns nil if the context was not created by the server.
+func RemoteAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey{}).(net.Addr)
+	return addr
+}
+
+// ConnID returns the identifier of the connection that sent the message being handled.
+// Identifiers are unique within a Server and are included in the server's log lines as "conn_id".
+// It returns an empty string if the context was not created by the server.
+func ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+// CorrelationID returns the correlation ID extracted from the message being handled by the CorrelationExtractor.
+// It returns nil if no CorrelationExtractor is configured.
+func CorrelationID(ctx context.Context) []byte {
+	id, _ := ctx.Value(correlationIDKey{}).([]byte)
+	return id
+}
+
+// TLSState returns the state of the TLS connection that sent the message being handled,
+// such as the negotiated version and cipher suite, once the handshake is completed.
+// It returns nil if the connection does not use TLS.
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state
+}
+
+// ClientCert returns the leaf certificate presented by the client during the TLS handshake.
+// It returns nil if the connection does not use TLS or the client did not present a certificate.
+// The certificate is verified according to the ClientAuth policy of the TLSConfig.
+func ClientCert(ctx context.Context) *x509.Certificate {
+	state := TLSState(ctx)
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+// ConnBytes returns the number of bytes read from and written to the connection so far.
+// Bytes are counted as sent on the wire, so for connections using TLSConfig or upgraded with StartTLS
+// they include the handshake and the record overhead, before and after the upgrade alike.
+// The context passed to OnConnect can be kept to learn the final counts once OnDisconnect is called.
+// It returns zero counts if the context was not created by the server.
+func ConnBytes(ctx context.Context) (read, written int64) {
+	conn, _ := ctx.Value(countingConnKey{}).(*countingConn)
+	if conn == nil {
+		return 0, 0
+	}
+
+	return conn.read.Load(), conn.written.Load()
+}
+
+// Session returns a store for per-connection state, such as authentication results or sequence numbers,
+// shared by all the messages of the connection and discarded when it is closed.
+// It returns nil if the context was not created by the server for a stream connection.
+func Session(ctx context.Context) *sync.Map {
+	session, _ := ctx.Value(sessionKey{}).(*sync.Map)
+	return session
+}
@@ -0,0 +1,215 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Handler: remoteAddrHandler})
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Timeout: testTimeout}
+	raw, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer raw.Close()
+
+	conn := newTestConn(t, raw)
+	if got, want := conn.roundTrip("hello"), raw.LocalAddr().String(); got != want {
+		t.Errorf("got remote address %q, want %q", got, want)
+	}
+}
+
+func TestConnID(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return []byte(tcpserver.ConnID(ctx) + "\n"), nil
+		},
+	})
+
+	first, second := dial(t, addr), dial(t, addr)
+	firstID, secondID := first.roundTrip("hello"), second.roundTrip("hello")
+
+	if firstID == "" || secondID == "" {
+		t.Fatalf("got connection IDs %q and %q, want non-empty IDs", firstID, secondID)
+	}
+
+	if firstID == secondID {
+		t.Errorf("got the same ID %q for two connections", firstID)
+	}
+
+	if got := first.roundTrip("again"); got != firstID {
+		t.Errorf("got ID %q for the second message, want %q", got, firstID)
+	}
+
+	if got := tcpserver.ConnID(context.Background()); got != "" {
+		t.Errorf("got ID %q outside of the server, want an empty ID", got)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	recorder, logger := newLogRecorder()
+	_, addr := startServer(t, tcpserver.Config{
+		Logger: logger,
+		CorrelationExtractor: func(message []byte) ([]byte, []byte) {
+			id, rest, _ := bytes.Cut(message, []byte(" "))
+			return id, rest
+		},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "fail\n" {
+				return nil, errors.New("handler failed")
+			}
+
+			return append(tcpserver.CorrelationID(ctx), " "+string(message)...), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	if got, want := conn.roundTrip("id-1 hello"), "id-1 hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	conn.send("id-2 fail\n")
+	conn.expectClosed()
+
+	records := recorder.waitRecords(t, "failed to process message", 1)
+	if got := records[0]["correlation_id"]; got != "id-2" {
+		t.Errorf("got correlation_id %v, want %q", got, "id-2")
+	}
+}
+
+func TestConnBytes(t *testing.T) {
+	connected := make(chan context.Context, 1)
+	disconnected := make(chan struct{})
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			read, written := tcpserver.ConnBytes(ctx)
+			return []byte(strconv.FormatInt(read, 10) + " " + strconv.FormatInt(written, 10) + "\n"), nil
+		},
+		OnConnect: func(ctx context.Context, addr net.Addr) {
+			connected <- ctx
+		},
+		OnDisconnect: func(addr net.Addr, err error) {
+			close(disconnected)
+		},
+	})
+
+	conn := dial(t, addr)
+	if got, want := conn.roundTrip("hello"), "6 0"; got != want {
+		t.Errorf("got counts %q, want %q", got, want)
+	}
+
+	if got, want := conn.roundTrip("world!"), "13 4"; got != want {
+		t.Errorf("got counts %q, want %q", got, want)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	ctx := <-connected
+	<-disconnected
+
+	if read, written := tcpserver.ConnBytes(ctx); read != 13 || written != 9 {
+		t.Errorf("got %d bytes read and %d written, want 13 and 9", read, written)
+	}
+}
+
+func TestSession(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			session := tcpserver.Session(ctx)
+
+			command, value, _ := strings.Cut(strings.TrimSpace(string(message)), " ")
+			if command == "set" {
+				session.Store("user", value)
+				return []byte("ok\n"), nil
+			}
+
+			user, ok := session.Load("user")
+			if !ok {
+				return []byte("anonymous\n"), nil
+			}
+
+			return []byte(user.(string) + "\n"), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("get"); got != "anonymous" {
+		t.Errorf("got %q before setting the user, want %q", got, "anonymous")
+	}
+
+	conn.roundTrip("set gopher")
+	if got := conn.roundTrip("get"); got != "gopher" {
+		t.Errorf("got %q, want %q", got, "gopher")
+	}
+
+	if got := dial(t, addr).roundTrip("get"); got != "anonymous" {
+		t.Errorf("got %q on another connection, want %q", got, "anonymous")
+	}
+}
+
+func TestHandlerContextDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  tcpserver.Config
+		want time.Duration
+	}{
+		{name: "none", cfg: tcpserver.Config{}},
+		{name: "read timeout", cfg: tcpserver.Config{ReadTimeout: 3 * time.Second}, want: 3 * time.Second},
+		{name: "handler timeout", cfg: tcpserver.Config{HandlerTimeout: 2 * time.Second}, want: 2 * time.Second},
+		{
+			name: "handler timeout sooner",
+			cfg:  tcpserver.Config{ReadTimeout: 10 * time.Second, HandlerTimeout: 2 * time.Second},
+			want: 2 * time.Second,
+		},
+		{
+			name: "read timeout sooner",
+			cfg:  tcpserver.Config{ReadTimeout: 3 * time.Second, HandlerTimeout: 10 * time.Second},
+			want: 3 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Handler = func(ctx context.Context, message []byte) ([]byte, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					return []byte("none\n"), nil
+				}
+
+				return []byte(strconv.FormatInt(int64(time.Until(deadline)), 10) + "\n"), nil
+			}
+
+			_, addr := startServer(t, tt.cfg)
+
+			got := dial(t, addr).roundTrip("hello")
+			if tt.want == 0 {
+				if got != "none" {
+					t.Errorf("got a deadline in %s ns, want none", got)
+				}
+
+				return
+			}
+
+			remaining, err := strconv.ParseInt(got, 10, 64)
+			if err != nil {
+				t.Fatalf("got %q, want the time left until the deadline", got)
+			}
+
+			if d := time.Duration(remaining); d > tt.want || d < tt.want-time.Second {
+				t.Errorf("got a deadline in %v, want close to %v", d, tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,17 @@ package tcpserver
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 )
 
-type newLineEncodeDecoder struct{}
+type newLineEncodeDecoder struct {
+	maxMessageSize int
+}
 
 func (n *newLineEncodeDecoder) Encode(w io.Writer, p []byte) error {
 	_, err := w.Write(p)
@@ -16,7 +20,79 @@ func (n *newLineEncodeDecoder) Encode(w io.Writer, p []byte) error {
 }
 
 func (n *newLineEncodeDecoder) Decode(r io.Reader) ([]byte, error) {
-	return bufio.NewReader(r).ReadBytes('\n')
+	return ReadMessage(r, '\n', n.maxMessageSize)
+}
+
+// isEmpty reports whether message holds nothing but the delimiter.
+func (n *newLineEncodeDecoder) isEmpty(message []byte) bool {
+	return len(message) == 0 || string(message) == "\n"
+}
+
+// ReadMessage reads from r up to and including the first occurrence of delim, like bufio.Reader.ReadBytes,
+// but rejects messages larger than maxSize bytes with ErrMessageTooLarge as soon as they exceed it.
+// If maxSize is zero or negative, there is no limit. If the stream ends before delim, the bytes read
+// are returned with the error, usually io.EOF. Custom decoders should pass the *bufio.Reader they are given:
+// any other reader is read one byte at a time, see bufferReader.
+//
+// Reads that return no data and no error are retried, up to the limit of bufio.Reader,
+// after which io.ErrNoProgress is returned, so a misbehaving connection cannot make it spin forever.
+func ReadMessage(r io.Reader, delim byte, maxSize int) ([]byte, error) {
+	br := bufferReader(r)
+
+	if maxSize <= 0 {
+		return br.ReadBytes(delim)
+	}
+
+	// Consume only the buffered bytes on each iteration so the size is checked
+	// as data arrives instead of blocking until a full buffer or the delimiter is read.
+	var message []byte
+	for {
+		if _, err := br.Peek(1); err != nil {
+			return message, err
+		}
+
+		chunk, _ := br.Peek(br.Buffered())
+		if i := bytes.IndexByte(chunk, delim); i >= 0 {
+			chunk = chunk[:i+1]
+		}
+
+		if len(message)+len(chunk) > maxSize {
+			return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, maxSize)
+		}
+
+		message = append(message, chunk...)
+		if _, err := br.Discard(len(chunk)); err != nil {
+			return nil, err
+		}
+
+		if message[len(message)-1] == delim {
+			return message, nil
+		}
+	}
+}
+
+// bufferReader returns r if it is a *bufio.Reader, such as the reader the server passes to Decode.
+// Otherwise, it wraps r in a bufio.Reader that reads one byte at a time, so decoding a message
+// does not read ahead bytes of the next one that would be lost with the wrapper once Decode returns.
+func bufferReader(r io.Reader) *bufio.Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return br
+	}
+
+	return bufio.NewReader(byteReader{r})
+}
+
+// byteReader reads at most one byte per call from r.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+
+	return b.r.Read(p)
 }
 
 func echo(ctx context.Context, message []byte) ([]byte, error) {
@@ -29,25 +105,46 @@ func defaultConfig(config ...Config) Config {
 		cfg = config[0]
 	}
 
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
 	if cfg.Address == "" {
 		cfg.Address = "127.0.0.1:0"
 	}
 
+	if len(cfg.Addresses) == 0 {
+		cfg.Addresses = []string{cfg.Address}
+	}
+
 	if cfg.Handler == nil {
 		cfg.Handler = echo
 	}
 
 	if cfg.Decoder == nil {
-		cfg.Decoder = &newLineEncodeDecoder{}
+		cfg.Decoder = &newLineEncodeDecoder{maxMessageSize: cfg.MaxMessageSize}
 	}
 
 	if cfg.Encoder == nil {
 		cfg.Encoder = &newLineEncodeDecoder{}
 	}
 
+	if cfg.SubnetPrefixIPv4 == 0 {
+		cfg.SubnetPrefixIPv4 = 24
+	}
+
+	if cfg.SubnetPrefixIPv6 == 0 {
+		cfg.SubnetPrefixIPv6 = 64
+	}
+
 	if cfg.ListenerAddrFunc == nil {
+		logger, level := cfg.Logger, cfg.LogLevel
 		cfg.ListenerAddrFunc = func(addr net.Addr) {
-			slog.Info("server listening", "addr", addr.String())
+			logger.Log(context.Background(), level, "server listening", "addr", addr.String())
 		}
 	}
 
@@ -0,0 +1,89 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// stallingReader returns (0, nil) stalls times before each of its chunks, and io.EOF once they are read.
+// A chunk larger than the buffer given to Read is returned over several calls.
+type stallingReader struct {
+	stalls int
+	chunks []string
+	count  int
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.count < r.stalls {
+		r.count++
+		return 0, nil
+	}
+
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.chunks[0])
+	if r.chunks[0] = r.chunks[0][n:]; len(r.chunks[0]) == 0 {
+		r.count = 0
+		r.chunks = r.chunks[1:]
+	}
+
+	return n, nil
+}
+
+func TestReadMessageRetriesEmptyReads(t *testing.T) {
+	for _, maxSize := range []int{0, 64} {
+		r := bufio.NewReader(&stallingReader{stalls: 3, chunks: []string{"hel", "lo\nwor", "ld\n"}})
+
+		for _, want := range []string{"hello\n", "world\n"} {
+			got, err := tcpserver.ReadMessage(r, '\n', maxSize)
+			if err != nil {
+				t.Fatalf("failed to read with a maximum of %d bytes: %v", maxSize, err)
+			}
+
+			if string(got) != want {
+				t.Errorf("got %q with a maximum of %d bytes, want %q", got, maxSize, want)
+			}
+		}
+	}
+}
+
+func TestReadMessageNoProgress(t *testing.T) {
+	// bufio.Reader gives up after 100 consecutive empty reads.
+	for _, maxSize := range []int{0, 64} {
+		if _, err := tcpserver.ReadMessage(&stallingReader{stalls: 1000}, '\n', maxSize); !errors.Is(err, io.ErrNoProgress) {
+			t.Errorf("got error %v with a maximum of %d bytes, want %v", err, maxSize, io.ErrNoProgress)
+		}
+	}
+}
+
+func TestReadMessageMaxSize(t *testing.T) {
+	r := &stallingReader{stalls: 2, chunks: []string{"too ", "long\n"}}
+
+	if _, err := tcpserver.ReadMessage(r, '\n', 8); !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+}
+
+func TestReadMessageUnbufferedReader(t *testing.T) {
+	for _, maxSize := range []int{0, 64} {
+		r := strings.NewReader("hello\nworld\n")
+
+		for _, want := range []string{"hello\n", "world\n"} {
+			got, err := tcpserver.ReadMessage(r, '\n', maxSize)
+			if err != nil {
+				t.Fatalf("failed to read with a maximum of %d bytes: %v", maxSize, err)
+			}
+
+			if string(got) != want {
+				t.Errorf("got %q with a maximum of %d bytes, want %q", got, maxSize, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DelimiterCodec is a Decoder and Encoder for messages terminated by a delimiter, such as "\r\n".
+// Unlike the default new line codec, Encode appends the delimiter to every message.
+type DelimiterCodec struct {
+	// Delimiter terminates every message. It can be longer than one byte.
+	// If empty, "\n" is used.
+	Delimiter string
+
+	// KeepDelimiter makes Decode return messages with their delimiter.
+	// By default, it is stripped.
+	KeepDelimiter bool
+
+	// MaxSize is the maximum size of a message in bytes, including the delimiter.
+	// Messages larger than MaxSize are rejected with ErrMessageTooLarge.
+	// If zero, there is no limit.
+	MaxSize int
+}
+
+// Decode reads from r up to and including the delimiter.
+// A message cut short by the end of the stream is reported as io.ErrUnexpectedEOF.
+// If r is not a *bufio.Reader, it is read one byte at a time, so no byte past the delimiter is consumed.
+func (d *DelimiterCodec) Decode(r io.Reader) ([]byte, error) {
+	br := bufferReader(r)
+
+	delimiter := d.delimiter()
+	last := delimiter[len(delimiter)-1]
+
+	var message []byte
+	for {
+		chunk, err := br.ReadSlice(last)
+		if d.MaxSize > 0 && len(message)+len(chunk) > d.MaxSize {
+			return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, d.MaxSize)
+		}
+
+		message = append(message, chunk...)
+		switch {
+		case err == nil:
+			if !bytes.HasSuffix(message, []byte(delimiter)) {
+				continue
+			}
+
+			if !d.KeepDelimiter {
+				message = message[:len(message)-len(delimiter)]
+			}
+
+			return message, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(message) > 0:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Encode writes p followed by the delimiter to w.
+func (d *DelimiterCodec) Encode(w io.Writer, p []byte) error {
+	frame := make([]byte, 0, len(p)+len(d.delimiter()))
+	frame = append(frame, p...)
+	frame = append(frame, d.delimiter()...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// isEmpty reports whether message holds nothing but the delimiter, which Decode keeps if KeepDelimiter is set.
+func (d *DelimiterCodec) isEmpty(message []byte) bool {
+	return len(message) == 0 || (d.KeepDelimiter && string(message) == d.delimiter())
+}
+
+func (d *DelimiterCodec) delimiter() string {
+	if d.Delimiter == "" {
+		return "\n"
+	}
+
+	return d.Delimiter
+}
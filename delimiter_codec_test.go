@@ -0,0 +1,99 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestDelimiterCodecRoundTrip(t *testing.T) {
+	messages := []string{"hello", "line with \n inside", "", "last \r"}
+
+	for _, keep := range []bool{false, true} {
+		codec := &tcpserver.DelimiterCodec{Delimiter: "\r\n", KeepDelimiter: keep}
+
+		var buf bytes.Buffer
+		for _, message := range messages {
+			if err := codec.Encode(&buf, []byte(message)); err != nil {
+				t.Fatalf("failed to encode %q: %v", message, err)
+			}
+		}
+
+		r := bufio.NewReader(&buf)
+		for _, message := range messages {
+			want := message
+			if keep {
+				want += "\r\n"
+			}
+
+			got, err := codec.Decode(r)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			if string(got) != want {
+				t.Errorf("got %q with KeepDelimiter %v, want %q", got, keep, want)
+			}
+		}
+
+		if _, err := codec.Decode(r); !errors.Is(err, io.EOF) {
+			t.Errorf("got error %v at the end of the stream, want %v", err, io.EOF)
+		}
+	}
+}
+
+func TestDelimiterCodecTruncatedMessage(t *testing.T) {
+	codec := &tcpserver.DelimiterCodec{Delimiter: "\r\n"}
+
+	if _, err := codec.Decode(strings.NewReader("no delimiter\r")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDelimiterCodecMaxSize(t *testing.T) {
+	codec := &tcpserver.DelimiterCodec{Delimiter: "\r\n", MaxSize: 8}
+
+	if _, err := codec.Decode(strings.NewReader("far too long\r\n")); !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+}
+
+func TestDelimiterCodecOverServer(t *testing.T) {
+	codec := &tcpserver.DelimiterCodec{Delimiter: "\r\n"}
+	_, addr := startServer(t, tcpserver.Config{Decoder: codec, Encoder: codec})
+
+	conn := dial(t, addr)
+	conn.send("hello\r\nworld\r\n")
+
+	for _, want := range []string{"hello", "world"} {
+		got, err := codec.Decode(conn.reader)
+		if err != nil {
+			t.Fatalf("failed to decode the response: %v", err)
+		}
+
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDelimiterCodecUnbufferedReader(t *testing.T) {
+	codec := &tcpserver.DelimiterCodec{Delimiter: "\r\n"}
+	r := strings.NewReader("hello\r\nworld\r\n")
+
+	for _, want := range []string{"hello", "world"} {
+		got, err := codec.Decode(r)
+		if err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
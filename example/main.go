@@ -10,7 +10,7 @@ import (
 )
 
 func main() {
-	server := tcpserver.New(tcpserver.Config{Address: "127.0.0.1:8080"})
+	server := tcpserver.New(tcpserver.Config{Address: "127.0.0.1:8080", AllowDefaultHandler: true})
 
 	errCh := make(chan error, 1)
 	go func() {
@@ -0,0 +1,49 @@
+package tcpserver
+
+import (
+	"fmt"
+	"io"
+)
+
+// FixedSize is a Decoder and Encoder for fixed-width records, where every message is exactly RecordSize bytes.
+type FixedSize struct {
+	// RecordSize is the size of every record in bytes. It must be positive.
+	RecordSize int
+}
+
+// Decode reads exactly RecordSize bytes from r.
+// A record cut short by the end of the stream is reported as io.ErrUnexpectedEOF.
+func (f *FixedSize) Decode(r io.Reader) ([]byte, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, f.RecordSize)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Encode writes p to w. It returns an error if p is not exactly RecordSize bytes.
+func (f *FixedSize) Encode(w io.Writer, p []byte) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	if len(p) != f.RecordSize {
+		return fmt.Errorf("invalid record of %d bytes: must be %d", len(p), f.RecordSize)
+	}
+
+	_, err := w.Write(p)
+	return err
+}
+
+func (f *FixedSize) validate() error {
+	if f.RecordSize <= 0 {
+		return fmt.Errorf("invalid record size %d: must be positive", f.RecordSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package tcpserver_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestFixedSizeDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		records []string
+		err     error
+	}{
+		{name: "exact", stream: "abcd", records: []string{"abcd"}, err: io.EOF},
+		{name: "short", stream: "ab", err: io.ErrUnexpectedEOF},
+		{name: "multiple records", stream: "abcdefghijkl", records: []string{"abcd", "efgh", "ijkl"}, err: io.EOF},
+		{name: "trailing partial record", stream: "abcdef", records: []string{"abcd"}, err: io.ErrUnexpectedEOF},
+	}
+
+	codec := &tcpserver.FixedSize{RecordSize: 4}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.stream)
+			for _, want := range tt.records {
+				got, err := codec.Decode(r)
+				if err != nil {
+					t.Fatalf("failed to decode: %v", err)
+				}
+
+				if string(got) != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+
+			if _, err := codec.Decode(r); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v at the end of the stream, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFixedSizeOverServer(t *testing.T) {
+	codec := &tcpserver.FixedSize{RecordSize: 4}
+	_, addr := startServer(t, tcpserver.Config{Decoder: codec, Encoder: codec})
+
+	conn := dial(t, addr)
+	conn.send("abcdefgh")
+
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(conn.reader, got); err != nil {
+		t.Fatalf("failed to read the responses: %v", err)
+	}
+
+	if string(got) != "abcdefgh" {
+		t.Errorf("got %q, want %q", got, "abcdefgh")
+	}
+}
+
+func TestFixedSizeEncodeInvalidRecord(t *testing.T) {
+	codec := &tcpserver.FixedSize{RecordSize: 4}
+	if err := codec.Encode(io.Discard, []byte("abc")); err == nil {
+		t.Error("expected an error encoding a record of the wrong size")
+	}
+
+	if _, err := (&tcpserver.FixedSize{}).Decode(strings.NewReader("abcd")); err == nil {
+		t.Error("expected an error decoding without a record size")
+	}
+}
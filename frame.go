@@ -0,0 +1,74 @@
+package tcpserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// Frame is a message made of a header, such as a type, flags or a length, and a body.
+type Frame struct {
+	Header []byte
+	Body   []byte
+}
+
+// FrameDecoder decodes structured frames instead of plain messages.
+// Like a Decoder, it is given the persistent *bufio.Reader of the connection.
+type FrameDecoder interface {
+	DecodeFrame(r io.Reader) (Frame, error)
+}
+
+// FrameHandler is an alternative to Handler that receives the frame decoded by the FrameDecoder.
+type FrameHandler func(ctx context.Context, frame Frame) ([]byte, error)
+
+type frameKey struct{}
+
+// fromFrameHandler adapts h to a Handler that reads the frame from the context.
+// Without a FrameDecoder, the frame is made of the message as its body.
+func fromFrameHandler(h FrameHandler) Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		frame, ok := ctx.Value(frameKey{}).(Frame)
+		if !ok {
+			frame = Frame{Body: message}
+		}
+
+		return h(ctx, frame)
+	}
+}
+
+// connCodec holds the decoders and the encoder used on a connection.
+type connCodec struct {
+	decoder      Decoder
+	frameDecoder FrameDecoder
+	encoder      Encoder
+}
+
+// codec returns the connCodec configured on the server.
+func (s *Server) codec() connCodec {
+	return connCodec{decoder: s.decoder, frameDecoder: s.frameDecoder, encoder: s.encoder}
+}
+
+// isEmpty reports whether message is empty, or only made of the delimiter for the built-in decoders that keep it.
+func (c connCodec) isEmpty(message []byte) bool {
+	if d, ok := c.decoder.(interface{ isEmpty(message []byte) bool }); ok && c.frameDecoder == nil {
+		return d.isEmpty(message)
+	}
+
+	return len(message) == 0
+}
+
+// decode reads the next message from r with the FrameDecoder of the codec if set, or its Decoder otherwise.
+// When a frame is decoded, it is stored in the returned context and its body is returned as the message.
+func (s *Server) decode(ctx context.Context, codec connCodec, r *bufio.Reader) (context.Context, []byte, error) {
+	if codec.frameDecoder == nil {
+		message, err := codec.decoder.Decode(r)
+		return ctx, message, err
+	}
+
+	frame, err := codec.frameDecoder.DecodeFrame(r)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	return context.WithValue(ctx, frameKey{}, frame), frame.Body, nil
+}
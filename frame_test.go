@@ -0,0 +1,71 @@
+package tcpserver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// typeLengthDecoder decodes frames made of a one byte type and a two bytes length, followed by the body.
+type typeLengthDecoder struct{}
+
+func (typeLengthDecoder) DecodeFrame(r io.Reader) (tcpserver.Frame, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return tcpserver.Frame{}, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return tcpserver.Frame{}, err
+	}
+
+	return tcpserver.Frame{Header: header, Body: body}, nil
+}
+
+// typeLengthFrame encodes body as a frame of the given type.
+func typeLengthFrame(typ byte, body string) string {
+	frame := binary.BigEndian.AppendUint16([]byte{typ}, uint16(len(body)))
+	return string(append(frame, body...))
+}
+
+func TestFrameHandler(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		FrameDecoder: typeLengthDecoder{},
+		FrameHandler: func(ctx context.Context, frame tcpserver.Frame) ([]byte, error) {
+			return fmt.Appendf(nil, "type %d: %s\n", frame.Header[0], frame.Body), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.send(typeLengthFrame(1, "hello") + typeLengthFrame(2, "body with\nnew lines"))
+
+	for _, want := range []string{"type 1: hello", "type 2: body with"} {
+		if got := conn.readLine(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if got := conn.readLine(); got != "new lines" {
+		t.Errorf("got %q, want %q", got, "new lines")
+	}
+}
+
+func TestFrameDecoderWithHandler(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		FrameDecoder: typeLengthDecoder{},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return append(message, '\n'), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.send(typeLengthFrame(1, "only the body"))
+	if got := conn.readLine(); got != "only the body" {
+		t.Errorf("got %q, want %q", got, "only the body")
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/emacampolo/tcpserver
 
 go 1.22
+
+require (
+	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.30.0
+)
@@ -0,0 +1,31 @@
+package tcpserver
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// GobCodec is a Decoder and Encoder for gob values framed with a length prefix.
+// Each frame is a self-contained gob stream, so frames can be decoded independently.
+// The Handler receives the raw gob stream of each frame and can decode it with Unmarshal,
+// then build the response with Marshal, as shown for JSONCodec.
+//
+// The embedded LengthPrefix configures the framing.
+type GobCodec struct {
+	LengthPrefix
+}
+
+// Marshal returns the gob encoding of v as a self-contained stream.
+func (c *GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the gob stream in p and stores the result in the value pointed to by v.
+func (c *GobCodec) Unmarshal(p []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(p)).Decode(v)
+}
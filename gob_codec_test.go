@@ -0,0 +1,11 @@
+package tcpserver_test
+
+import (
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestGobCodec(t *testing.T) {
+	testValueCodec(t, &tcpserver.GobCodec{})
+}
@@ -0,0 +1,17 @@
+package tcpserver
+
+import "context"
+
+// FromFunc adapts a function that neither needs the context nor fails to a Handler.
+func FromFunc(f func(message []byte) []byte) Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		return f(message), nil
+	}
+}
+
+// WithError adapts a function that does not need the context to a Handler.
+func WithError(f func(message []byte) ([]byte, error)) Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		return f(message)
+	}
+}
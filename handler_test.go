@@ -0,0 +1,38 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestFromFunc(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Handler: tcpserver.FromFunc(bytes.ToUpper)})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "HELLO" {
+		t.Errorf("got %q, want %q", got, "HELLO")
+	}
+}
+
+func TestWithError(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: tcpserver.WithError(func(message []byte) ([]byte, error) {
+			if string(message) == "fail\n" {
+				return nil, errors.New("invalid message")
+			}
+
+			return bytes.ToUpper(message), nil
+		}),
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("hello"); got != "HELLO" {
+		t.Errorf("got %q, want %q", got, "HELLO")
+	}
+
+	// Without an ErrorEncoder, the error closes the connection.
+	conn.send("fail\n")
+	conn.expectClosed()
+}
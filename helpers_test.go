@@ -0,0 +1,355 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// testTimeout bounds every wait of the tests, so a broken server fails them instead of hanging.
+const testTimeout = 5 * time.Second
+
+// discardLogger returns a logger that drops every record.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// logRecorder collects the records of a JSON logger, so tests can assert on their attributes.
+type logRecorder struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+// newLogRecorder returns a recorder and a logger writing to it at the debug level.
+func newLogRecorder() (*logRecorder, *slog.Logger) {
+	r := &logRecorder{}
+	return r, slog.New(slog.NewJSONHandler(r, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func (r *logRecorder) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.buf.Write(p)
+}
+
+// records returns the records logged with msg, decoded as JSON objects.
+func (r *logRecorder) records(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(r.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("failed to decode log record %q: %v", line, err)
+		}
+
+		if record[slog.MessageKey] == msg {
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+// waitRecords waits until n records are logged with msg and returns them.
+func (r *logRecorder) waitRecords(t *testing.T, msg string, n int) []map[string]any {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		records := r.records(t, msg)
+		if len(records) >= n {
+			return records
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d records logged with %q, want %d", len(records), msg, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitNoConnections waits until the server is done serving every connection.
+func waitNoConnections(t *testing.T, server *tcpserver.Server) {
+	t.Helper()
+
+	waitActiveConnections(t, server, 0)
+}
+
+// waitActiveConnections waits until the server is serving n connections.
+func waitActiveConnections(t *testing.T, server *tcpserver.Server, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for server.Stats().ActiveConnections != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d active connections, want %d", server.Stats().ActiveConnections, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingListener returns the queued errors from Accept before accepting from the wrapped listener.
+type failingListener struct {
+	net.Listener
+
+	mux  sync.Mutex
+	errs []error
+}
+
+// newFailingListener listens on a random local port and fails the first accepts with errs.
+func newFailingListener(t *testing.T, errs ...error) *failingListener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	return &failingListener{Listener: listener, errs: errs}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mux.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mux.Unlock()
+		return nil, err
+	}
+	l.mux.Unlock()
+
+	return l.Listener.Accept()
+}
+
+// temporaryError is an accept error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// startServer starts a server with cfg and waits until it is listening.
+// The server is shut down when the test finishes. Unless cfg sets them, it logs nothing
+// and the default echo Handler is allowed.
+func startServer(t testing.TB, cfg tcpserver.Config) (*tcpserver.Server, string) {
+	t.Helper()
+
+	if cfg.Logger == nil {
+		cfg.Logger = discardLogger()
+	}
+
+	if cfg.ListenerAddrFunc == nil {
+		cfg.ListenerAddrFunc = tcpserver.NoopListenerAddrFunc
+	}
+
+	cfg.AllowDefaultHandler = true
+
+	server := tcpserver.New(cfg)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	addr, err := server.WaitAddr(ctx)
+	if err != nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	})
+
+	return server, addr.String()
+}
+
+// testConn is a client connection whose reads are bounded by testTimeout.
+type testConn struct {
+	net.Conn
+	t      testing.TB
+	reader *bufio.Reader
+}
+
+// dial connects to the server listening on addr over TCP. The connection is closed when the test finishes.
+func dial(t testing.TB, addr string) *testConn {
+	t.Helper()
+
+	return dialNetwork(t, "tcp", addr)
+}
+
+func dialNetwork(t testing.TB, network, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, addr, testTimeout)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return newTestConn(t, conn)
+}
+
+func newTestConn(t testing.TB, conn net.Conn) *testConn {
+	if err := conn.SetDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	return &testConn{Conn: conn, t: t, reader: bufio.NewReader(conn)}
+}
+
+// send writes s to the connection as is.
+func (c *testConn) send(s string) {
+	c.t.Helper()
+
+	if _, err := io.WriteString(c.Conn, s); err != nil {
+		c.t.Fatalf("failed to write %q: %v", s, err)
+	}
+}
+
+// readLine reads a response terminated by a new line and returns it without the new line.
+func (c *testConn) readLine() string {
+	c.t.Helper()
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read response: %v (read %q)", err, line)
+	}
+
+	return strings.TrimSuffix(line, "\n")
+}
+
+// roundTrip sends message followed by a new line and returns the response line.
+func (c *testConn) roundTrip(message string) string {
+	c.t.Helper()
+
+	c.send(message + "\n")
+	return c.readLine()
+}
+
+// closeWrite shuts down the writing side of the connection, so the server reads io.EOF.
+func (c *testConn) closeWrite() {
+	c.t.Helper()
+
+	if err := c.Conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		c.t.Fatalf("failed to close write: %v", err)
+	}
+}
+
+// expectClosed asserts the server closes the connection without writing anything else.
+func (c *testConn) expectClosed() {
+	c.t.Helper()
+
+	b, err := c.reader.ReadByte()
+	if err == nil {
+		c.t.Fatalf("expected the connection to be closed, read %q", b)
+	}
+
+	if isTimeout(err) {
+		c.t.Fatal("expected the connection to be closed, but it is still open")
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return err != nil && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// newCertificate returns a self-signed certificate for localhost and 127.0.0.1 with the given common name,
+// along with a pool trusting it.
+func newCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// newTLSConfigs returns the server config of a self-signed certificate and a client config trusting it.
+func newTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+
+	cert, pool := newCertificate(t, "localhost")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, &tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+// upgradeTLS performs the client side TLS handshake on c and returns the encrypted connection.
+// The bytes already buffered by c are discarded, so the server must not have sent anything else.
+func (c *testConn) upgradeTLS(config *tls.Config) *testConn {
+	c.t.Helper()
+
+	tlsConn := tls.Client(c.Conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("failed to perform TLS handshake: %v", err)
+	}
+
+	return newTestConn(c.t, tlsConn)
+}
@@ -0,0 +1,62 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrInvalidJSON is returned by JSONCodec when a frame does not hold a valid JSON document.
+var ErrInvalidJSON = errors.New("invalid JSON")
+
+// JSONCodec is a Decoder and Encoder for JSON documents framed with a length prefix.
+// The Handler receives the raw JSON document of each frame and can decode it with Unmarshal,
+// then build the response with Marshal:
+//
+//	codec := &tcpserver.JSONCodec{}
+//	handler := func(ctx context.Context, message []byte) ([]byte, error) {
+//		var req Request
+//		if err := codec.Unmarshal(message, &req); err != nil {
+//			return nil, err
+//		}
+//
+//		return codec.Marshal(Response{...})
+//	}
+//
+// The embedded LengthPrefix configures the framing.
+type JSONCodec struct {
+	LengthPrefix
+}
+
+// Decode reads a frame and checks that it holds a valid JSON document.
+func (c *JSONCodec) Decode(r io.Reader) ([]byte, error) {
+	message, err := c.LengthPrefix.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(message) {
+		return nil, ErrInvalidJSON
+	}
+
+	return message, nil
+}
+
+// Encode checks that p is a valid JSON document and writes it as a frame.
+func (c *JSONCodec) Encode(w io.Writer, p []byte) error {
+	if !json.Valid(p) {
+		return ErrInvalidJSON
+	}
+
+	return c.LengthPrefix.Encode(w, p)
+}
+
+// Marshal returns the JSON encoding of v.
+func (c *JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON document in p and stores the result in the value pointed to by v.
+func (c *JSONCodec) Unmarshal(p []byte, v any) error {
+	return json.Unmarshal(p, v)
+}
@@ -0,0 +1,76 @@
+package tcpserver_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// valueCodec is a codec that marshals Go values, such as JSONCodec and GobCodec.
+type valueCodec interface {
+	tcpserver.Decoder
+	tcpserver.Encoder
+	Marshal(v any) ([]byte, error)
+	Unmarshal(p []byte, v any) error
+}
+
+type order struct {
+	ID    int
+	Items []string
+	Total float64
+}
+
+// testValueCodec sends an order to a server that decodes it, adds an item and sends it back.
+func testValueCodec(t *testing.T, codec valueCodec) {
+	t.Helper()
+
+	_, addr := startServer(t, tcpserver.Config{
+		Decoder: codec,
+		Encoder: codec,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			var o order
+			if err := codec.Unmarshal(message, &o); err != nil {
+				return nil, err
+			}
+
+			o.Items = append(o.Items, "receipt")
+			return codec.Marshal(o)
+		},
+	})
+
+	client := dialClient(t, addr, tcpserver.ClientConfig{Encoder: codec, Decoder: codec})
+
+	request, err := codec.Marshal(order{ID: 7, Items: []string{"book"}, Total: 12.5})
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	response, err := client.Send(request)
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	var got order
+	if err := codec.Unmarshal(response, &got); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	if got.ID != 7 || got.Total != 12.5 || len(got.Items) != 2 || got.Items[0] != "book" || got.Items[1] != "receipt" {
+		t.Errorf("got %+v, want the order with a receipt", got)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	testValueCodec(t, &tcpserver.JSONCodec{})
+}
+
+func TestJSONCodecInvalidDocument(t *testing.T) {
+	codec := &tcpserver.JSONCodec{}
+
+	if err := codec.Encode(io.Discard, []byte("{not json")); !errors.Is(err, tcpserver.ErrInvalidJSON) {
+		t.Errorf("got encode error %v, want %v", err, tcpserver.ErrInvalidJSON)
+	}
+}
@@ -0,0 +1,128 @@
+package tcpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrMessageTooLarge is returned by the built-in codecs when a message exceeds the configured maximum size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// LengthPrefix is a Decoder and Encoder for messages framed with a length prefix.
+// Each message is preceded by its length, encoded as an unsigned integer of PrefixSize bytes.
+// Unlike the default new line codec, it can carry arbitrary binary payloads.
+type LengthPrefix struct {
+	// PrefixSize is the size of the length prefix in bytes. It must be 2 or 4.
+	// If zero, 4 is used.
+	PrefixSize int
+
+	// ByteOrder used to encode the length prefix.
+	// If nil, binary.BigEndian is used.
+	ByteOrder binary.ByteOrder
+
+	// MaxSize is the maximum size of a message in bytes.
+	// Messages larger than MaxSize are rejected with ErrMessageTooLarge.
+	// If zero, the maximum size is only bounded by the prefix size. Either way, the memory of a message
+	// is allocated as its bytes arrive, so a large prefix alone does not allocate the announced size.
+	MaxSize int
+}
+
+// Decode reads the length prefix and then exactly that many bytes from r.
+func (l *LengthPrefix) Decode(r io.Reader) ([]byte, error) {
+	prefixSize, err := l.prefixSize()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	switch prefixSize {
+	case 2:
+		size = uint64(l.byteOrder().Uint16(prefix))
+	case 4:
+		size = uint64(l.byteOrder().Uint32(prefix))
+	}
+
+	maxSize := uint64(math.MaxInt)
+	if l.MaxSize > 0 {
+		maxSize = uint64(l.MaxSize)
+	}
+
+	if size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the maximum of %d", ErrMessageTooLarge, size, maxSize)
+	}
+
+	// The message is read as it arrives rather than allocated upfront, since the length comes from the client.
+	message := bytes.NewBuffer(make([]byte, 0, min(size, initialMessageSize)))
+	if _, err := io.CopyN(message, r, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// initialMessageSize is the capacity allocated for a message before its bytes arrive.
+const initialMessageSize = 4096
+
+// Encode writes the length prefix followed by p to w.
+func (l *LengthPrefix) Encode(w io.Writer, p []byte) error {
+	prefixSize, err := l.prefixSize()
+	if err != nil {
+		return err
+	}
+
+	var maxSize uint64 = math.MaxUint32
+	if prefixSize == 2 {
+		maxSize = math.MaxUint16
+	}
+
+	if l.MaxSize > 0 {
+		maxSize = min(maxSize, uint64(l.MaxSize))
+	}
+
+	if uint64(len(p)) > maxSize {
+		return fmt.Errorf("%w: %d bytes exceeds the maximum of %d", ErrMessageTooLarge, len(p), maxSize)
+	}
+
+	frame := make([]byte, prefixSize, prefixSize+len(p))
+	switch prefixSize {
+	case 2:
+		l.byteOrder().PutUint16(frame, uint16(len(p)))
+	case 4:
+		l.byteOrder().PutUint32(frame, uint32(len(p)))
+	}
+
+	_, err = w.Write(append(frame, p...))
+	return err
+}
+
+func (l *LengthPrefix) prefixSize() (int, error) {
+	switch l.PrefixSize {
+	case 0:
+		return 4, nil
+	case 2, 4:
+		return l.PrefixSize, nil
+	default:
+		return 0, fmt.Errorf("invalid prefix size %d: must be 2 or 4", l.PrefixSize)
+	}
+}
+
+func (l *LengthPrefix) byteOrder() binary.ByteOrder {
+	if l.ByteOrder == nil {
+		return binary.BigEndian
+	}
+
+	return l.ByteOrder
+}
@@ -0,0 +1,125 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestLengthPrefixRoundTrip(t *testing.T) {
+	codecs := map[string]*tcpserver.LengthPrefix{
+		"default":          {},
+		"2 bytes":          {PrefixSize: 2},
+		"4 bytes":          {PrefixSize: 4},
+		"4 bytes LE":       {PrefixSize: 4, ByteOrder: binary.LittleEndian},
+		"2 bytes with max": {PrefixSize: 2, MaxSize: 1024},
+	}
+
+	messages := [][]byte{
+		[]byte("hello"),
+		[]byte("line one\nline two\n"),
+		{},
+		{0x00, 0xff, '\n', 0x00},
+		bytes.Repeat([]byte("x"), 1000),
+	}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for _, message := range messages {
+				if err := codec.Encode(&buf, message); err != nil {
+					t.Fatalf("failed to encode %q: %v", message, err)
+				}
+			}
+
+			for _, want := range messages {
+				got, err := codec.Decode(&buf)
+				if err != nil {
+					t.Fatalf("failed to decode: %v", err)
+				}
+
+				if !bytes.Equal(got, want) {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+
+			if _, err := codec.Decode(&buf); !errors.Is(err, io.EOF) {
+				t.Errorf("got error %v at the end of the stream, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestLengthPrefixOverServer(t *testing.T) {
+	codec := &tcpserver.LengthPrefix{}
+	_, addr := startServer(t, tcpserver.Config{Decoder: codec, Encoder: codec})
+
+	conn := dial(t, addr)
+	for _, message := range []string{"first\nwith new lines\n", "second"} {
+		if err := codec.Encode(conn, []byte(message)); err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+
+		got, err := codec.Decode(conn.reader)
+		if err != nil {
+			t.Fatalf("failed to decode the response: %v", err)
+		}
+
+		if string(got) != message {
+			t.Errorf("got %q, want %q", got, message)
+		}
+	}
+}
+
+func TestLengthPrefixMaxSize(t *testing.T) {
+	codec := &tcpserver.LengthPrefix{PrefixSize: 2, MaxSize: 4}
+
+	if err := codec.Encode(io.Discard, []byte("too long")); !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got encode error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+
+	frame := []byte{0x00, 0x08}
+	frame = append(frame, "too long"...)
+	if _, err := codec.Decode(bytes.NewReader(frame)); !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got decode error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+}
+
+func TestLengthPrefixInvalidPrefixSize(t *testing.T) {
+	codec := &tcpserver.LengthPrefix{PrefixSize: 3}
+
+	if err := codec.Encode(io.Discard, []byte("hello")); err == nil {
+		t.Error("expected an error encoding with an invalid prefix size")
+	}
+
+	if _, err := codec.Decode(bytes.NewReader([]byte{0, 0, 0, 5})); err == nil {
+		t.Error("expected an error decoding with an invalid prefix size")
+	}
+}
+
+func TestLengthPrefixHugeLengthIsNotAllocated(t *testing.T) {
+	codec := &tcpserver.LengthPrefix{}
+
+	frame := []byte{0xff, 0xff, 0xff, 0xff}
+	frame = append(frame, "short payload"...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err := codec.Decode(bytes.NewReader(frame))
+
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decoding a truncated message allocated %d bytes", allocated)
+	}
+}
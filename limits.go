@@ -0,0 +1,127 @@
+package tcpserver
+
+import (
+	"net"
+	"net/netip"
+)
+
+// addrIP returns the IP address of addr, if any.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
+
+// acquireIP reserves a connection slot for the IP of addr when PerIPConnectionLimit is set.
+// It returns false if the IP already reached the limit. Addresses without an IP are not limited.
+func (s *Server) acquireIP(addr net.Addr) bool {
+	if s.perIPLimit <= 0 {
+		return true
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+
+	s.ipMux.Lock()
+	defer s.ipMux.Unlock()
+
+	if s.ipConns[ip] >= s.perIPLimit {
+		return false
+	}
+
+	s.ipConns[ip]++
+	return true
+}
+
+// releaseIP releases the slot reserved by acquireIP.
+func (s *Server) releaseIP(addr net.Addr) {
+	if s.perIPLimit <= 0 {
+		return
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return
+	}
+
+	s.ipMux.Lock()
+	defer s.ipMux.Unlock()
+
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+// addrSubnet returns the subnet of the IP address of addr, if any.
+func (s *Server) addrSubnet(addr net.Addr) (netip.Prefix, bool) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	bits := s.subnetBitsIPv6
+	if ip.Is4() {
+		bits = s.subnetBitsIPv4
+	}
+
+	subnet, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return subnet, true
+}
+
+// acquireSubnet reserves a connection slot for the subnet of addr when PerSubnetConnectionLimit is set.
+// It returns false if the subnet already reached the limit. Addresses without an IP are not limited.
+func (s *Server) acquireSubnet(addr net.Addr) bool {
+	if s.perSubnetLimit <= 0 {
+		return true
+	}
+
+	subnet, ok := s.addrSubnet(addr)
+	if !ok {
+		return true
+	}
+
+	s.ipMux.Lock()
+	defer s.ipMux.Unlock()
+
+	if s.subnetConns[subnet] >= s.perSubnetLimit {
+		return false
+	}
+
+	s.subnetConns[subnet]++
+	return true
+}
+
+// releaseSubnet releases the slot reserved by acquireSubnet.
+func (s *Server) releaseSubnet(addr net.Addr) {
+	if s.perSubnetLimit <= 0 {
+		return
+	}
+
+	subnet, ok := s.addrSubnet(addr)
+	if !ok {
+		return
+	}
+
+	s.ipMux.Lock()
+	defer s.ipMux.Unlock()
+
+	if s.subnetConns[subnet]--; s.subnetConns[subnet] <= 0 {
+		delete(s.subnetConns, subnet)
+	}
+}
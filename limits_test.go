@@ -0,0 +1,81 @@
+package tcpserver_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// expectServedEventually dials addr until a connection is served, failing the test if none is within the test timeout.
+func expectServedEventually(t *testing.T, addr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		conn := dial(t, addr)
+		conn.send("hello\n")
+
+		b, err := conn.reader.ReadByte()
+		_ = conn.Close()
+		if err == nil && b == 'h' {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the connection was not served")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPerIPConnectionLimit(t *testing.T) {
+	const limit = 2
+	_, addr := startServer(t, tcpserver.Config{PerIPConnectionLimit: limit})
+
+	var conns []*testConn
+	for range limit {
+		conn := dial(t, addr)
+		if got := conn.roundTrip("hello"); got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+
+		conns = append(conns, conn)
+	}
+
+	extra := dial(t, addr)
+	extra.send("hello\n")
+	extra.expectClosed()
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	expectServedEventually(t, addr)
+}
+
+func TestPerSubnetConnectionLimit(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{ProxyProtocol: true, PerSubnetConnectionLimit: 2})
+
+	// The PROXY protocol header sets the client address, so several IPs can share a subnet.
+	dialFrom := func(ip string) *testConn {
+		conn := dial(t, addr)
+		conn.send("PROXY TCP4 " + ip + " 192.0.2.254 56324 443\r\n")
+		return conn
+	}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if got := dialFrom(ip).roundTrip("hello"); got != "hello" {
+			t.Fatalf("got %q from %s, want %q", got, ip, "hello")
+		}
+	}
+
+	over := dialFrom("192.0.2.3")
+	over.send("hello\n")
+	over.expectClosed()
+
+	if got := dialFrom("198.51.100.1").roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q from another subnet, want %q", got, "hello")
+	}
+}
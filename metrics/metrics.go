@@ -0,0 +1,119 @@
+// Package metrics exposes Prometheus metrics for a tcpserver.Server.
+// It is a separate module, so that the tcpserver module does not depend on Prometheus.
+package metrics
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the activity of a server and implements prometheus.Collector,
+// so it can be registered with a prometheus.Registerer once Instrument wires it to the server config.
+type Metrics struct {
+	activeConnections prometheus.Gauge
+	totalConnections  prometheus.Counter
+	messages          *prometheus.CounterVec
+	handlerLatency    prometheus.Histogram
+}
+
+// New creates the metrics with the given namespace, which prefixes every metric name if not empty.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "tcpserver",
+			Name:      "active_connections",
+			Help:      "Number of connections being served.",
+		}),
+		totalConnections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "tcpserver",
+			Name:      "connections_total",
+			Help:      "Number of connections served since the server started.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "tcpserver",
+			Name:      "messages_total",
+			Help:      "Number of messages handled, by result.",
+		}, []string{"result"}),
+		handlerLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "tcpserver",
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of the Handler invocations.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+// Instrument returns cfg with its OnConnect, OnDisconnect and OnMessage hooks wrapped to record the metrics.
+// The hooks already set in cfg are still called.
+func (m *Metrics) Instrument(cfg tcpserver.Config) tcpserver.Config {
+	onConnect, onDisconnect, onMessage := cfg.OnConnect, cfg.OnDisconnect, cfg.OnMessage
+
+	cfg.OnConnect = func(ctx context.Context, addr net.Addr) {
+		m.OnConnect(ctx, addr)
+		if onConnect != nil {
+			onConnect(ctx, addr)
+		}
+	}
+
+	cfg.OnDisconnect = func(addr net.Addr, err error) {
+		m.OnDisconnect(addr, err)
+		if onDisconnect != nil {
+			onDisconnect(addr, err)
+		}
+	}
+
+	cfg.OnMessage = func(addr net.Addr, size int, dur time.Duration, err error) {
+		m.OnMessage(addr, size, dur, err)
+		if onMessage != nil {
+			onMessage(addr, size, dur, err)
+		}
+	}
+
+	return cfg
+}
+
+// OnConnect records a new connection. It can be used as the Config.OnConnect hook.
+func (m *Metrics) OnConnect(ctx context.Context, addr net.Addr) {
+	m.totalConnections.Inc()
+	m.activeConnections.Inc()
+}
+
+// OnDisconnect records a closed connection. It can be used as the Config.OnDisconnect hook.
+func (m *Metrics) OnDisconnect(addr net.Addr, err error) {
+	m.activeConnections.Dec()
+}
+
+// OnMessage records a handled message and the duration of the Handler. It can be used as the Config.OnMessage hook.
+func (m *Metrics) OnMessage(addr net.Addr, size int, dur time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.messages.WithLabelValues(result).Inc()
+	m.handlerLatency.Observe(dur.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.activeConnections.Describe(ch)
+	m.totalConnections.Describe(ch)
+	m.messages.Describe(ch)
+	m.handlerLatency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.activeConnections.Collect(ch)
+	m.totalConnections.Collect(ch)
+	m.messages.Collect(ch)
+	m.handlerLatency.Collect(ch)
+}
@@ -0,0 +1,112 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+	"github.com/emacampolo/tcpserver/metrics"
+	"github.com/emacampolo/tcpserver/tcpservertest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// value returns the value of the metric with the given name and result label, if any, or zero if it was not gathered.
+func value(t *testing.T, registry *prometheus.Registry, name, result string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather the metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			if result != "" && (len(metric.GetLabel()) != 1 || metric.GetLabel()[0].GetValue() != result) {
+				continue
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				return metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New("test")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+
+	addr, _ := tcpservertest.RunServer(t, m.Instrument(tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "fail\n" {
+				return nil, errors.New("failed")
+			}
+
+			return message, nil
+		},
+	}))
+
+	client, err := tcpserver.Dial(addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	for range 2 {
+		if _, err := client.Send([]byte("hello\n")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+
+	want := map[string]float64{
+		"test_tcpserver_active_connections":       1,
+		"test_tcpserver_connections_total":        1,
+		"test_tcpserver_handler_duration_seconds": 2,
+	}
+
+	for name, want := range want {
+		if got := value(t, registry, name, ""); got != want {
+			t.Errorf("got %s %v, want %v", name, got, want)
+		}
+	}
+
+	if got := value(t, registry, "test_tcpserver_messages_total", "ok"); got != 2 {
+		t.Errorf("got %v messages handled successfully, want 2", got)
+	}
+
+	// A Handler error closes the connection.
+	if _, err := client.Send([]byte("fail\n")); err == nil {
+		t.Fatal("expected the connection to be closed by the handler error")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for value(t, registry, "test_tcpserver_active_connections", "") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection was still active once closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := value(t, registry, "test_tcpserver_messages_total", "error"); got != 1 {
+		t.Errorf("got %v messages that failed, want 1", got)
+	}
+
+	if got := value(t, registry, "test_tcpserver_connections_total", ""); got != 1 {
+		t.Errorf("got %v connections in total, want 1", got)
+	}
+}
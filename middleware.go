@@ -0,0 +1,50 @@
+package tcpserver
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Middleware wraps a Handler to add cross-cutting behavior such as logging, authentication or metrics.
+type Middleware func(Handler) Handler
+
+// chain wraps handler with the given middlewares so that the first middleware is the outermost one.
+func chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Recover returns a Middleware that recovers from panics in the wrapped Handler and logs the panic value
+// and stack to logger, or the default logger if nil, with the connection ID when available.
+// The message that caused the panic gets no response and the connection keeps being served,
+// unlike a panic that reaches the server, which closes the connection.
+func Recover(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, message []byte) (response []byte, err error) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+
+				attrs := []any{"panic", v, "stack", string(debug.Stack())}
+				if id := ConnID(ctx); id != "" {
+					attrs = append(attrs, "conn_id", id)
+				}
+
+				logger.Error("panic handling message", attrs...)
+				response, err = nil, nil
+			}()
+
+			return next(ctx, message)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// marker returns a Middleware that appends name to the response of the wrapped Handler.
+func marker(name string) tcpserver.Middleware {
+	return func(next tcpserver.Handler) tcpserver.Handler {
+		return func(ctx context.Context, message []byte) ([]byte, error) {
+			response, err := next(ctx, message)
+			return append(response, " "+name...), err
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Encoder:    &tcpserver.DelimiterCodec{Delimiter: "\n"},
+		Middleware: []tcpserver.Middleware{marker("first"), marker("second")},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return bytes.TrimSpace(message), nil
+		},
+	})
+
+	// The first middleware is the outermost one, so it is the first to run and the last to see the response.
+	if got, want := dial(t, addr).roundTrip("hello"), "hello second first"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	recorder, logger := newLogRecorder()
+	_, addr := startServer(t, tcpserver.Config{
+		Middleware: []tcpserver.Middleware{tcpserver.Recover(logger)},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "panic\n" {
+				panic("boom")
+			}
+
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	// The message that panicked gets no response, and the connection keeps being served.
+	conn.send("panic\n")
+	if got := conn.roundTrip("still there"); got != "still there" {
+		t.Errorf("got %q after the panic, want %q", got, "still there")
+	}
+
+	records := recorder.records(t, "panic handling message")
+	if len(records) != 1 {
+		t.Fatalf("got %d panic records, want 1", len(records))
+	}
+
+	record := records[0]
+	if record["panic"] != "boom" {
+		t.Errorf("got panic %v, want %q", record["panic"], "boom")
+	}
+
+	if stack, _ := record["stack"].(string); !strings.Contains(stack, "TestRecover") {
+		t.Errorf("got stack %q, want the stack of the handler", stack)
+	}
+
+	if id, _ := record["conn_id"].(string); id == "" {
+		t.Error("the panic was logged without the connection ID")
+	}
+}
@@ -0,0 +1,216 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// maxDatagramSize is the largest payload a UDP datagram can carry.
+const maxDatagramSize = 64 * 1024
+
+// isPacketNetwork reports whether network is served with net.ListenPacket instead of net.Listen.
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	default:
+		return false
+	}
+}
+
+// datagram is a datagram queued to the worker pool.
+type datagram struct {
+	conn net.PacketConn
+	addr net.Addr
+	data []byte
+}
+
+// fromPacketHandler adapts a PacketHandler to a Handler that reads the source address from the context.
+func fromPacketHandler(h func(ctx context.Context, src net.Addr, message []byte) ([]byte, error)) Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		return h(ctx, RemoteAddr(ctx), message)
+	}
+}
+
+// servePackets reads datagrams from conn until it is closed and handles each one in its own goroutine,
+// queues it to datagrams when the worker pool is enabled, or handles it inline when Sequential is set.
+func (s *Server) servePackets(ctx context.Context, conn net.PacketConn, datagrams chan<- datagram) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosing.Load() {
+				return nil
+			}
+
+			if isTemporary(err) {
+				s.logger.Warn("failed to read datagram, retrying", "error", err)
+				continue
+			}
+
+			return err
+		}
+
+		data := bytes.Clone(buf[:n])
+
+		if datagrams != nil {
+			datagrams <- datagram{conn: conn, addr: addr, data: data}
+			continue
+		}
+
+		if s.sequential {
+			s.serveSequential(ctx, conn, addr, data)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			s.servePacket(ctx, conn, addr, data)
+		}()
+	}
+}
+
+// serveSequential serves a datagram on the calling goroutine, one at a time across all the packet connections.
+func (s *Server) serveSequential(ctx context.Context, conn net.PacketConn, addr net.Addr, data []byte) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	s.seqMux.Lock()
+	defer s.seqMux.Unlock()
+
+	s.servePacket(ctx, conn, addr, data)
+}
+
+// servePacket decodes a single datagram, invokes the PacketHandler or the Handler and writes the response back to addr.
+func (s *Server) servePacket(ctx context.Context, conn net.PacketConn, addr net.Addr, datagram []byte) {
+	defer s.recoverPanic(s.logger, addr, nil)
+
+	ctx = context.WithValue(ctx, remoteAddrKey{}, addr)
+
+	codec := s.codec()
+	ctx, message, err := s.decode(ctx, codec, s.newReader(bytes.NewReader(datagram)))
+	if err != nil {
+		s.reportError(s.logger, addr, "decode", err, "failed to decode datagram", "addr", addr.String())
+		return
+	}
+
+	s.totalMessages.Add(1)
+
+	if s.skipEmpty && codec.isEmpty(message) {
+		return
+	}
+
+	ctx, logger, message := s.correlate(ctx, s.logger, message)
+
+	writer := &packetResponseWriter{conn: conn, addr: addr, encoder: s.encoder}
+	handler := s.handler
+	if s.packetHandler != nil {
+		handler = s.packetHandler
+	}
+
+	response, err := s.handle(ctx, logger, handler, message, time.Time{}, writer)
+	if writer.err != nil {
+		s.writeDatagramError(logger, addr, writer.err)
+		return
+	}
+
+	if errors.Is(err, ErrHandlerTimeout) {
+		if err := writer.Write(s.timeoutResponse); err != nil {
+			s.writeDatagramError(logger, addr, err)
+		}
+
+		return
+	}
+
+	if err != nil && !errors.Is(err, ErrCloseConnection) {
+		s.reportError(logger, addr, "handle", err, "failed to process message")
+		if s.errorEncoder == nil {
+			return
+		}
+
+		if payload := s.errorEncoder(ctx, err); payload != nil {
+			if err := writer.Write(payload); err != nil {
+				s.writeDatagramError(logger, addr, err)
+			}
+		}
+
+		return
+	}
+
+	if s.streamHandler != nil || response == nil {
+		return
+	}
+
+	response, err = s.intercept(ctx, message, response)
+	if err != nil {
+		logger.Error("failed to intercept response", "error", err)
+		return
+	}
+
+	if response == nil {
+		return
+	}
+
+	if err := writer.Write(response); err != nil {
+		s.writeDatagramError(logger, addr, err)
+	}
+}
+
+// writeDatagramError reports an error returned while writing a datagram to addr.
+func (s *Server) writeDatagramError(logger *slog.Logger, addr net.Addr, err error) {
+	if isConnClosed(err) {
+		logger.Debug("packet connection closed", "addr", addr.String(), "error", err)
+		return
+	}
+
+	s.reportError(logger, addr, "encode", err, "failed to write datagram", "addr", addr.String())
+}
+
+// packetResponseWriter writes each response as a single datagram to addr.
+type packetResponseWriter struct {
+	conn    net.PacketConn
+	addr    net.Addr
+	encoder Encoder
+
+	// err is the first error returned by Write.
+	err error
+}
+
+func (w *packetResponseWriter) Write(p []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	var buf bytes.Buffer
+	if err := w.encoder.Encode(&buf, p); err != nil {
+		w.err = err
+		return err
+	}
+
+	_, w.err = w.conn.WriteTo(buf.Bytes(), w.addr)
+	return w.err
+}
+
+// ReadFrom writes the content of r as is in a single datagram.
+func (w *packetResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		w.err = err
+		return 0, err
+	}
+
+	n, err := w.conn.WriteTo(data, w.addr)
+	w.err = err
+	return int64(n), err
+}
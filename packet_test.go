@@ -0,0 +1,74 @@
+package tcpserver_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// dialUDP connects a UDP socket to addr. The socket is closed when the test finishes.
+func dialUDP(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if err := conn.SetDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	return conn
+}
+
+// exchange sends message as a single datagram and returns the reply.
+func exchange(t *testing.T, conn net.Conn, message string) string {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestUDPEcho(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Network: "udp", Address: "127.0.0.1:0"})
+
+	conn := dialUDP(t, addr)
+	for _, message := range []string{"hello\n", "world\n"} {
+		if got := exchange(t, conn, message); got != message {
+			t.Errorf("got %q, want %q", got, message)
+		}
+	}
+}
+
+func TestPacketHandlerRepliesToEachSource(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Network: "udp",
+		Address: "127.0.0.1:0",
+		PacketHandler: func(ctx context.Context, src net.Addr, message []byte) ([]byte, error) {
+			return []byte(src.String()), nil
+		},
+	})
+
+	first, second := dialUDP(t, addr), dialUDP(t, addr)
+	for range 2 {
+		for _, conn := range []net.Conn{first, second} {
+			if got, want := exchange(t, conn, "who am I\n"), conn.LocalAddr().String(); got != want {
+				t.Errorf("got reply %q, want %q", got, want)
+			}
+		}
+	}
+}
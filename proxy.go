@@ -0,0 +1,136 @@
+package tcpserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyMaxIdleConns is the maximum number of idle upstream connections kept by a ProxyHandler.
+	proxyMaxIdleConns = 16
+
+	// proxyMaxIdleTime is how long an upstream connection may stay idle in the pool before it is closed,
+	// so connections are not kept past the idle timeout of a typical upstream.
+	proxyMaxIdleTime = 30 * time.Second
+)
+
+// ProxyHandler returns a Handler that forwards each message to the upstream server and returns its response,
+// so the server acts as a reverse proxy. The upstream is dialed with config, whose Encoder and Decoder
+// must match the upstream codec, and connections are pooled for reuse across messages and client connections.
+// The Handler context bounds both the dial and the exchange; a connection that fails or is interrupted is discarded.
+//
+// A pooled connection may have been closed by the upstream while idle, so if it fails before any byte of
+// the response is read, the message is sent once more on a newly dialed connection. The upstream may then
+// receive the message twice, if it handled it but closed the connection before responding.
+// Connections idle for more than 30 seconds are closed instead of being reused.
+//
+// The returned close function closes the idle connections, and the ones in use once their exchange completes.
+// Call it when the Handler is no longer used, typically from the OnShutdown callback of the server.
+func ProxyHandler(upstream string, config ...ClientConfig) (Handler, func()) {
+	pool := &clientPool{address: upstream, config: config}
+
+	handler := func(ctx context.Context, message []byte) ([]byte, error) {
+		client, reused, err := pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		received := client.received()
+		response, err := client.SendContext(ctx, message)
+		if err != nil && reused && client.received() == received && ctx.Err() == nil {
+			_ = client.Close()
+
+			client, err = DialContext(ctx, pool.address, pool.config...)
+			if err != nil {
+				return nil, err
+			}
+
+			response, err = client.SendContext(ctx, message)
+		}
+
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+
+		pool.put(client)
+		return response, nil
+	}
+
+	return handler, pool.close
+}
+
+// clientPool keeps idle clients connected to the same address.
+type clientPool struct {
+	address string
+	config  []ClientConfig
+
+	mux    sync.Mutex
+	idle   []idleClient
+	closed bool
+}
+
+// idleClient is a client waiting in the pool and the time it was returned to it.
+type idleClient struct {
+	client *Client
+	since  time.Time
+}
+
+// get returns the most recently used idle client, or dials a new one if there is none.
+// reused reports whether the client comes from the pool.
+func (p *clientPool) get(ctx context.Context) (client *Client, reused bool, err error) {
+	p.mux.Lock()
+	p.evictLocked(time.Now())
+	if n := len(p.idle); n > 0 {
+		client := p.idle[n-1].client
+		p.idle = p.idle[:n-1]
+		p.mux.Unlock()
+
+		return client, true, nil
+	}
+	p.mux.Unlock()
+
+	client, err = DialContext(ctx, p.address, p.config...)
+	return client, false, err
+}
+
+// put returns client to the pool, or closes it if the pool is full or closed.
+func (p *clientPool) put(client *Client) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	now := time.Now()
+	p.evictLocked(now)
+	if p.closed || len(p.idle) >= proxyMaxIdleConns {
+		_ = client.Close()
+		return
+	}
+
+	p.idle = append(p.idle, idleClient{client: client, since: now})
+}
+
+// evictLocked closes the clients idle for more than proxyMaxIdleTime.
+// The oldest clients are first in the pool. p.mux must be held.
+func (p *clientPool) evictLocked(now time.Time) {
+	n := 0
+	for n < len(p.idle) && now.Sub(p.idle[n].since) > proxyMaxIdleTime {
+		_ = p.idle[n].client.Close()
+		n++
+	}
+
+	p.idle = p.idle[n:]
+}
+
+// close closes the idle clients and makes put close the clients returned afterwards.
+func (p *clientPool) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, idle := range p.idle {
+		_ = idle.client.Close()
+	}
+
+	p.idle = nil
+	p.closed = true
+}
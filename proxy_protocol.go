@@ -0,0 +1,179 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when a connection does not start with a valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+const (
+	// proxyV1MaxLength is the maximum length of a v1 header, including the trailing CRLF.
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2Version      = 0x2
+	proxyV2CmdLocal     = 0x0
+	proxyV2CmdProxy     = 0x1
+	proxyV2FamilyINET   = 0x1
+	proxyV2FamilyINET6  = 0x2
+	proxyV2FamilyUnix   = 0x3
+	proxyV2Datagram     = 0x2
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyHeader reads a PROXY protocol header from r, bounded by the ReadTimeout if set.
+// It returns the source address carried by the header, or nil if the header does not carry one,
+// in which case the connection address should be used.
+func (s *Server) readProxyHeader(conn net.Conn, r *bufio.Reader) (net.Addr, error) {
+	if s.readTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(peek, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(peek, proxyV1Prefix):
+		return readProxyV1(r)
+	default:
+		return nil, fmt.Errorf("%w: missing signature", ErrInvalidProxyHeader)
+	}
+}
+
+// readProxyV1 reads a human-readable header such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not terminated by CRLF", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: v1 header has %d fields", ErrInvalidProxyHeader, len(fields))
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source address %q", ErrInvalidProxyHeader, fields[2])
+	}
+
+	switch fields[1] {
+	case "TCP4":
+		if !ip.Is4() {
+			return nil, fmt.Errorf("%w: source address %q is not IPv4", ErrInvalidProxyHeader, fields[2])
+		}
+	case "TCP6":
+		if !ip.Is6() {
+			return nil, fmt.Errorf("%w: source address %q is not IPv6", ErrInvalidProxyHeader, fields[2])
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported v1 protocol %q", ErrInvalidProxyHeader, fields[1])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port %q", ErrInvalidProxyHeader, fields[4])
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header: the signature, the version and command, the address family,
+// the length of the address block and the address block itself.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if version := header[12] >> 4; version != proxyV2Version {
+		return nil, fmt.Errorf("%w: unsupported v2 version %d", ErrInvalidProxyHeader, version)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch cmd := header[12] & 0x0f; cmd {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unsupported v2 command %d", ErrInvalidProxyHeader, cmd)
+	}
+
+	family, transport := header[13]>>4, header[13]&0x0f
+
+	var ip netip.Addr
+	var port uint16
+	switch family {
+	case proxyV2FamilyINET:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short v2 IPv4 address block", ErrInvalidProxyHeader)
+		}
+
+		ip = netip.AddrFrom4([4]byte(payload[0:4]))
+		port = binary.BigEndian.Uint16(payload[8:10])
+	case proxyV2FamilyINET6:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short v2 IPv6 address block", ErrInvalidProxyHeader)
+		}
+
+		ip = netip.AddrFrom16([16]byte(payload[0:16]))
+		port = binary.BigEndian.Uint16(payload[32:34])
+	case proxyV2FamilyUnix:
+		if len(payload) < 216 {
+			return nil, fmt.Errorf("%w: short v2 unix address block", ErrInvalidProxyHeader)
+		}
+
+		name, _, _ := bytes.Cut(payload[0:108], []byte{0})
+		return &net.UnixAddr{Name: string(name), Net: "unix"}, nil
+	default:
+		return nil, nil
+	}
+
+	addrPort := netip.AddrPortFrom(ip, port)
+	if transport == proxyV2Datagram {
+		return net.UDPAddrFromAddrPort(addrPort), nil
+	}
+
+	return net.TCPAddrFromAddrPort(addrPort), nil
+}
@@ -0,0 +1,128 @@
+package tcpserver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// remoteAddrHandler answers each message with the remote address seen by the Handler.
+func remoteAddrHandler(ctx context.Context, message []byte) ([]byte, error) {
+	return []byte(tcpserver.RemoteAddr(ctx).String() + "\n"), nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{
+			name:   "v1 TCP4",
+			header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v1 TCP6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			want:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2 IPv4",
+			header: proxyV2Header(0x1, 0x11, append(append(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()...), 0xdc, 0x04, 0x01, 0xbb)),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v2 IPv6",
+			header: proxyV2Header(0x1, 0x21, append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)),
+			want:   "[2001:db8::1]:56324",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, tcpserver.Config{ProxyProtocol: true, Handler: remoteAddrHandler})
+
+			conn := dial(t, addr)
+			conn.send(string(tt.header))
+			if got := conn.roundTrip("hello"); got != tt.want {
+				t.Errorf("got remote address %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolWithoutAddress(t *testing.T) {
+	headers := map[string][]byte{
+		"v1 UNKNOWN": []byte("PROXY UNKNOWN\r\n"),
+		"v2 LOCAL":   proxyV2Header(0x0, 0x00, nil),
+	}
+
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			_, addr := startServer(t, tcpserver.Config{ProxyProtocol: true, Handler: remoteAddrHandler})
+
+			conn := dial(t, addr)
+			conn.send(string(header))
+			if got, want := conn.roundTrip("hello"), conn.LocalAddr().String(); got != want {
+				t.Errorf("got remote address %q, want the connection address %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolInvalidHeader(t *testing.T) {
+	headers := map[string]string{
+		"missing":           "hello world\n",
+		"v1 too few fields": "PROXY TCP4 192.0.2.1 56324\r\n",
+		"v1 without CRLF":   "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+		"v1 bad address":    "PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n",
+		"v2 bad version":    "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+	}
+
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			var served atomic.Bool
+			_, addr := startServer(t, tcpserver.Config{
+				ProxyProtocol: true,
+				Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+					served.Store(true)
+					return message, nil
+				},
+			})
+
+			conn := dial(t, addr)
+			conn.send(header + "hello\n")
+			conn.expectClosed()
+
+			if served.Load() {
+				t.Error("the Handler was invoked for a connection with an invalid header")
+			}
+		})
+	}
+}
+
+func TestProxyProtocolWithTLS(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{ProxyProtocol: true, TLSConfig: serverConfig, Handler: remoteAddrHandler})
+
+	conn := dial(t, addr)
+	conn.send("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+
+	tlsConn := conn.upgradeTLS(clientConfig)
+	if got, want := tlsConn.roundTrip("hello"), "192.0.2.1:56324"; got != want {
+		t.Errorf("got remote address %q, want %q", got, want)
+	}
+}
+
+// proxyV2Header returns a v2 header with the given command, family and transport, and address block.
+func proxyV2Header(command, familyTransport byte, addresses []byte) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x20|command, familyTransport)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
@@ -0,0 +1,100 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// startProxy starts a server forwarding messages to upstream with a ProxyHandler,
+// whose connections are released when the test ends.
+func startProxy(t *testing.T, upstream string) string {
+	t.Helper()
+
+	handler, closeProxy := tcpserver.ProxyHandler(upstream)
+	t.Cleanup(closeProxy)
+
+	_, addr := startServer(t, tcpserver.Config{Handler: handler})
+	return addr
+}
+
+func TestProxyHandler(t *testing.T) {
+	_, upstream := startServer(t, tcpserver.Config{Handler: tcpserver.FromFunc(bytes.ToUpper)})
+	addr := startProxy(t, upstream)
+
+	for range 2 {
+		conn := dial(t, addr)
+		for _, message := range []string{"hello", "world"} {
+			if got, want := conn.roundTrip(message), string(bytes.ToUpper([]byte(message))); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	}
+}
+
+func TestProxyHandlerUpstreamUnavailable(t *testing.T) {
+	upstreamServer, upstream := startServer(t, tcpserver.Config{})
+	upstreamServer.Shutdown()
+
+	addr := startProxy(t, upstream)
+
+	conn := dial(t, addr)
+	conn.send("hello\n")
+	conn.expectClosed()
+}
+
+func TestProxyHandlerUpstreamIdleTimeout(t *testing.T) {
+	disconnected := make(chan struct{}, 1)
+	_, upstream := startServer(t, tcpserver.Config{
+		Handler:     tcpserver.FromFunc(bytes.ToUpper),
+		IdleTimeout: 50 * time.Millisecond,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- struct{}{}
+		},
+	})
+	addr := startProxy(t, upstream)
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("hello"); got != "HELLO" {
+		t.Errorf("got %q, want %q", got, "HELLO")
+	}
+
+	// The upstream closes the pooled connection before the next message is proxied.
+	select {
+	case <-disconnected:
+	case <-time.After(testTimeout):
+		t.Fatal("the upstream did not close the idle connection")
+	}
+
+	if got := conn.roundTrip("world"); got != "WORLD" {
+		t.Errorf("got %q, want %q", got, "WORLD")
+	}
+}
+
+func TestProxyHandlerClose(t *testing.T) {
+	disconnected := make(chan struct{}, 1)
+	_, upstream := startServer(t, tcpserver.Config{
+		Handler: tcpserver.FromFunc(bytes.ToUpper),
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- struct{}{}
+		},
+	})
+
+	handler, closeProxy := tcpserver.ProxyHandler(upstream)
+	_, addr := startServer(t, tcpserver.Config{Handler: handler})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "HELLO" {
+		t.Errorf("got %q, want %q", got, "HELLO")
+	}
+
+	closeProxy()
+
+	select {
+	case <-disconnected:
+	case <-time.After(testTimeout):
+		t.Fatal("the pooled upstream connection was not closed")
+	}
+}
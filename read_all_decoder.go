@@ -0,0 +1,40 @@
+package tcpserver
+
+import (
+	"fmt"
+	"io"
+)
+
+// ReadAllDecoder is a Decoder that reads the whole connection as a single message,
+// for protocols where the client signals the end of the message by closing its write side,
+// for instance with (*net.TCPConn).CloseWrite. The response can still be written back
+// on the half-closed connection, which is then closed.
+type ReadAllDecoder struct {
+	// MaxSize is the maximum size of the message in bytes.
+	// Larger messages are rejected with ErrMessageTooLarge.
+	// If zero, there is no limit.
+	MaxSize int
+}
+
+// Decode reads from r until the end of the stream.
+// It returns io.EOF if there is nothing left to read, so an empty stream produces no message.
+func (d *ReadAllDecoder) Decode(r io.Reader) ([]byte, error) {
+	if d.MaxSize > 0 {
+		r = io.LimitReader(r, int64(d.MaxSize)+1)
+	}
+
+	message, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.MaxSize > 0 && len(message) > d.MaxSize {
+		return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, d.MaxSize)
+	}
+
+	if len(message) == 0 {
+		return nil, io.EOF
+	}
+
+	return message, nil
+}
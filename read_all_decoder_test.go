@@ -0,0 +1,44 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestReadAllDecoder(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Decoder: &tcpserver.ReadAllDecoder{},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return fmt.Appendf(nil, "%d lines, %d bytes\n", bytes.Count(message, []byte("\n")), len(message)), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for _, part := range []string{"first line\n", "second ", "line\n", "third line\n"} {
+		conn.send(part)
+	}
+
+	conn.closeWrite()
+
+	if got, want := conn.readLine(), "3 lines, 34 bytes"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if rest, err := io.ReadAll(conn.reader); err != nil || len(rest) != 0 {
+		t.Errorf("got %q and error %v after the response, want the connection closed", rest, err)
+	}
+}
+
+func TestReadAllDecoderMaxSize(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Decoder: &tcpserver.ReadAllDecoder{MaxSize: 8}})
+
+	conn := dial(t, addr)
+	conn.send("more than eight bytes")
+	conn.closeWrite()
+	conn.expectClosed()
+}
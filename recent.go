@@ -0,0 +1,90 @@
+package tcpserver
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// recentMessageMaxSize is the number of bytes of each message kept in a MessageRecord.
+const recentMessageMaxSize = 64
+
+// MessageRecord describes a message handled by the server, as returned by RecentMessages.
+type MessageRecord struct {
+	// RemoteAddr is the address of the client that sent the message.
+	RemoteAddr net.Addr
+
+	// Time is when the Handler was invoked.
+	Time time.Time
+
+	// Message holds the first bytes of the message, truncated to 64 bytes.
+	Message []byte
+
+	// RequestSize is the size of the message in bytes.
+	RequestSize int
+
+	// ResponseSize is the size in bytes of the response returned by the Handler.
+	// It is zero for a StreamHandler, which writes its responses directly.
+	ResponseSize int
+
+	// Err is the error returned by the Handler, if any.
+	Err error
+}
+
+// RecentMessages returns the last messages handled by the server, oldest first,
+// up to the RecentBufferSize. It returns nil if RecentBufferSize is not set.
+func (s *Server) RecentMessages() []MessageRecord {
+	if s.recent == nil {
+		return nil
+	}
+
+	return s.recent.snapshot()
+}
+
+// recentBuffer is a ring buffer holding the last records added to it.
+type recentBuffer struct {
+	mux     sync.Mutex
+	records []MessageRecord
+	next    int
+	full    bool
+}
+
+func newRecentBuffer(size int) *recentBuffer {
+	return &recentBuffer{records: make([]MessageRecord, size)}
+}
+
+// add records a handled message, overwriting the oldest record once the buffer is full.
+func (b *recentBuffer) add(addr net.Addr, start time.Time, message, response []byte, err error) {
+	record := MessageRecord{
+		RemoteAddr:   addr,
+		Time:         start,
+		Message:      bytes.Clone(message[:min(len(message), recentMessageMaxSize)]),
+		RequestSize:  len(message),
+		ResponseSize: len(response),
+		Err:          err,
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.records[b.next] = record
+	b.next = (b.next + 1) % len(b.records)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// snapshot returns a copy of the records, oldest first.
+func (b *recentBuffer) snapshot() []MessageRecord {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.full {
+		return append([]MessageRecord(nil), b.records[:b.next]...)
+	}
+
+	records := make([]MessageRecord, 0, len(b.records))
+	records = append(records, b.records[b.next:]...)
+	return append(records, b.records[:b.next]...)
+}
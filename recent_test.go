@@ -0,0 +1,85 @@
+package tcpserver_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestRecentMessages(t *testing.T) {
+	errFail := errors.New("failed")
+	long := strings.Repeat("x", 100)
+
+	server, addr := startServer(t, tcpserver.Config{
+		RecentBufferSize: 3,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "fail\n" {
+				return nil, errFail
+			}
+
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for _, message := range []string{"one", "two", "three", long} {
+		conn.roundTrip(message)
+	}
+
+	// A Handler error closes the connection once the message is recorded.
+	conn.send("fail\n")
+	conn.expectClosed()
+
+	records := server.RecentMessages()
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+
+	want := []struct {
+		message string
+		size    int
+		err     error
+	}{
+		{message: "three\n", size: len("three\n")},
+		{message: long[:64], size: len(long) + 1},
+		{message: "fail\n", size: len("fail\n"), err: errFail},
+	}
+
+	for i, record := range records {
+		if got := string(record.Message); got != want[i].message {
+			t.Errorf("record %d: got message %q, want %q", i, got, want[i].message)
+		}
+
+		if record.RequestSize != want[i].size {
+			t.Errorf("record %d: got request size %d, want %d", i, record.RequestSize, want[i].size)
+		}
+
+		if want[i].err == nil && record.ResponseSize != want[i].size {
+			t.Errorf("record %d: got response size %d, want %d", i, record.ResponseSize, want[i].size)
+		}
+
+		if !errors.Is(record.Err, want[i].err) {
+			t.Errorf("record %d: got error %v, want %v", i, record.Err, want[i].err)
+		}
+
+		if got := record.RemoteAddr.String(); got != conn.LocalAddr().String() {
+			t.Errorf("record %d: got remote address %s, want %s", i, got, conn.LocalAddr())
+		}
+
+		if i > 0 && record.Time.Before(records[i-1].Time) {
+			t.Errorf("record %d: got time %v before the previous record", i, record.Time)
+		}
+	}
+}
+
+func TestRecentMessagesDisabled(t *testing.T) {
+	server, addr := startServer(t, tcpserver.Config{})
+	dial(t, addr).roundTrip("hello")
+
+	if records := server.RecentMessages(); records != nil {
+		t.Errorf("got %d records without RecentBufferSize, want nil", len(records))
+	}
+}
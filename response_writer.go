@@ -0,0 +1,310 @@
+package tcpserver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ResponseWriter encodes responses back to the client with the configured Encoder.
+type ResponseWriter interface {
+	// Write encodes p and writes it to the client.
+	// Once Write fails, the connection is closed after the handler returns
+	// and subsequent calls return the same error without writing anything.
+	Write(p []byte) error
+}
+
+// StreamHandler is an alternative to Handler that can write any number of responses for a single message.
+// The provided context is the same as the one passed to a Handler.
+type StreamHandler func(ctx context.Context, message []byte, w ResponseWriter) error
+
+// StreamResponseHandler is an alternative to Handler that returns the response as an io.Reader,
+// which is copied to the client instead of being held in memory.
+// The content of the reader is written as is, without the Encoder, and the reader is closed
+// once copied if it implements io.Closer. A nil reader writes nothing.
+// For packet networks, the whole content is written as a single datagram.
+type StreamResponseHandler func(ctx context.Context, message []byte) (io.Reader, error)
+
+// streamResponse adapts h to a StreamHandler that copies the returned reader to the ResponseWriter.
+func streamResponse(h StreamResponseHandler) StreamHandler {
+	return func(ctx context.Context, message []byte, w ResponseWriter) error {
+		r, err := h(ctx, message)
+		if r == nil {
+			return err
+		}
+
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		// Both the connection and the packet response writers implement io.ReaderFrom.
+		if _, copyErr := w.(io.ReaderFrom).ReadFrom(r); copyErr != nil {
+			return copyErr
+		}
+
+		return err
+	}
+}
+
+// connResponseWriter writes responses to a stream connection.
+// When batching is enabled, encoded responses are buffered and flushed once WriteBatchSize
+// responses are pending, WriteBatchWindow elapses or the handler returns.
+// When the write queue is enabled, responses are queued and written by a dedicated goroutine.
+type connResponseWriter struct {
+	conn         net.Conn
+	encoder      Encoder
+	writeTimeout time.Duration
+	clock        clock
+	batchSize    int
+	batchWindow  time.Duration
+
+	mux        sync.Mutex
+	writer     io.Writer
+	bufWriter  *bufio.Writer
+	compressor compressWriter
+	pending    int
+	timer      timer
+
+	// err is the first error returned by Write. Once set, the connection is no longer writable.
+	err error
+
+	queue       chan []byte
+	queuePolicy WriteQueuePolicy
+	inflight    sync.WaitGroup
+	drained     chan struct{}
+	failOnce    sync.Once
+	failed      chan struct{}
+
+	// queueErr is the first error of the write queue. It is set before failed is closed.
+	queueErr error
+}
+
+func (s *Server) newConnResponseWriter(conn net.Conn, encoder Encoder) *connResponseWriter {
+	w := &connResponseWriter{
+		conn:         conn,
+		encoder:      encoder,
+		writeTimeout: s.writeTimeout,
+		clock:        s.clock,
+		batchSize:    s.writeBatchSize,
+		batchWindow:  s.writeBatchWindow,
+		writer:       conn,
+		compressor:   s.compression.newWriter(conn),
+	}
+
+	if w.compressor != nil {
+		w.writer = w.compressor
+	}
+
+	bufferSize := s.writeBufferSize
+	if bufferSize <= 0 && w.batching() {
+		bufferSize = defaultWriteBufferSize
+	}
+
+	if bufferSize > 0 {
+		w.bufWriter = bufio.NewWriterSize(w.writer, bufferSize)
+		w.writer = w.bufWriter
+	}
+
+	if s.writeQueueSize > 0 {
+		w.queue = make(chan []byte, s.writeQueueSize)
+		w.queuePolicy = s.writeQueuePolicy
+		w.drained = make(chan struct{})
+		w.failed = make(chan struct{})
+		go w.drainQueue()
+	}
+
+	return w
+}
+
+// defaultWriteBufferSize is the size of the write buffer used for batching when WriteBufferSize is not set.
+const defaultWriteBufferSize = 4096
+
+func (w *connResponseWriter) batching() bool {
+	return w.batchSize > 1 || w.batchWindow > 0
+}
+
+func (w *connResponseWriter) Write(p []byte) error {
+	if w.queue != nil {
+		return w.enqueue(p)
+	}
+
+	return w.write(p)
+}
+
+// write encodes p to the connection, flushing it according to the batching settings.
+func (w *connResponseWriter) write(p []byte) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.setWriteDeadline(); err != nil {
+		w.err = err
+		return err
+	}
+
+	if err := w.encoder.Encode(w.writer, p); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.pending++
+	switch {
+	case !w.batching(), w.batchSize > 1 && w.pending >= w.batchSize:
+		w.err = w.flushLocked()
+	case w.batchWindow > 0 && w.timer == nil:
+		w.timer = w.clock.AfterFunc(w.batchWindow, func() {
+			_ = w.flush()
+		})
+	}
+
+	return w.err
+}
+
+// Flush writes any pending response to the connection.
+// It returns the first error returned by Write or Flush, if any.
+// When the write queue is enabled, it does not wait for the queued responses, which are flushed once written.
+func (w *connResponseWriter) Flush() error {
+	if w.queue != nil {
+		select {
+		case <-w.failed:
+			return w.queueErr
+		default:
+			return nil
+		}
+	}
+
+	return w.flush()
+}
+
+func (w *connResponseWriter) flush() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = w.flushLocked()
+	return w.err
+}
+
+func (w *connResponseWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	if w.pending == 0 {
+		return nil
+	}
+
+	w.pending = 0
+	if w.bufWriter == nil && w.compressor == nil {
+		return nil
+	}
+
+	if err := w.setWriteDeadline(); err != nil {
+		return err
+	}
+
+	if w.bufWriter != nil {
+		if err := w.bufWriter.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if w.compressor != nil {
+		return w.compressor.Flush()
+	}
+
+	return nil
+}
+
+// Close waits for the queued responses to be written, if any,
+// and ends the compressed stream, if any, once the connection is done.
+func (w *connResponseWriter) Close() error {
+	if w.queue != nil {
+		close(w.queue)
+		<-w.drained
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	if w.err != nil || w.compressor == nil {
+		return w.err
+	}
+
+	if err := w.setWriteDeadline(); err != nil {
+		return err
+	}
+
+	return w.compressor.Close()
+}
+
+// ReadFrom copies r to the connection as is, after any pending or queued response.
+// The write deadline is extended before each write, so WriteTimeout bounds every chunk
+// rather than the whole copy. Any error leaves the connection no longer writable.
+func (w *connResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.queue != nil {
+		w.inflight.Wait()
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.err = w.flushLocked(); w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := io.Copy(deadlineWriter{w}, r)
+	if err == nil && w.compressor != nil {
+		err = w.compressor.Flush()
+	}
+
+	w.err = err
+	return n, err
+}
+
+// deadlineWriter writes directly to the connection, or its compressor, extending the write deadline before each write.
+type deadlineWriter struct {
+	w *connResponseWriter
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	if err := d.w.setWriteDeadline(); err != nil {
+		return 0, err
+	}
+
+	if d.w.compressor != nil {
+		return d.w.compressor.Write(p)
+	}
+
+	return d.w.conn.Write(p)
+}
+
+func (w *connResponseWriter) setWriteDeadline() error {
+	if w.writeTimeout <= 0 {
+		return nil
+	}
+
+	return w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+}
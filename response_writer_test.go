@@ -0,0 +1,231 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestWriteBufferLargeResponse(t *testing.T) {
+	response := append(bytes.Repeat([]byte("0123456789"), 1<<17), '\n')
+	_, addr := startServer(t, tcpserver.Config{
+		WriteBufferSize: 4096,
+		WriteTimeout:    time.Second,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return response, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for range 2 {
+		if got := conn.roundTrip("hello"); got != string(response[:len(response)-1]) {
+			t.Fatalf("got a response of %d bytes, want %d", len(got), len(response)-1)
+		}
+	}
+}
+
+func TestStreamHandlerWritesSeveralResponses(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		StreamHandler: func(ctx context.Context, message []byte, w tcpserver.ResponseWriter) error {
+			for _, part := range []string{"one\n", "two\n", "three\n"} {
+				if err := w.Write([]byte(part)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for range 2 {
+		conn.send("count\n")
+		for _, want := range []string{"one", "two", "three"} {
+			if got := conn.readLine(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	}
+}
+
+// failingEncoder writes messages as is and fails from the given call onwards.
+type failingEncoder struct {
+	calls  atomic.Int64
+	failAt int64
+}
+
+var errEncode = errors.New("encode failed")
+
+func (e *failingEncoder) Encode(w io.Writer, p []byte) error {
+	if e.calls.Add(1) >= e.failAt {
+		return errEncode
+	}
+
+	_, err := w.Write(p)
+	return err
+}
+
+func TestEncoderErrorClosesConnection(t *testing.T) {
+	disconnected := make(chan error, 1)
+	server, addr := startServer(t, tcpserver.Config{
+		Encoder: &failingEncoder{failAt: 2},
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("first"); got != "first" {
+		t.Errorf("got %q, want %q", got, "first")
+	}
+
+	conn.send("second\n")
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, errEncode) {
+		t.Errorf("got disconnect error %v, want %v", err, errEncode)
+	}
+
+	waitNoConnections(t, server)
+}
+
+// frames returns a StreamHandler that writes n numbered responses for each message.
+func frames(n int) tcpserver.StreamHandler {
+	return func(ctx context.Context, message []byte, w tcpserver.ResponseWriter) error {
+		for i := range n {
+			if err := w.Write([]byte(strconv.Itoa(i) + "\n")); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func TestWriteBatchingKeepsOrder(t *testing.T) {
+	const n = 100
+
+	configs := map[string]tcpserver.Config{
+		"size":            {WriteBatchSize: 8},
+		"window":          {WriteBatchWindow: time.Millisecond},
+		"size and window": {WriteBatchSize: 8, WriteBatchWindow: time.Millisecond},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			cfg.StreamHandler = frames(n)
+			_, addr := startServer(t, cfg)
+
+			conn := dial(t, addr)
+			conn.send("go\n")
+			for i := range n {
+				if got, want := conn.readLine(), strconv.Itoa(i); got != want {
+					t.Fatalf("got frame %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteBatching(b *testing.B) {
+	const n = 64
+
+	for _, batchSize := range []int{1, 8, 64} {
+		b.Run("batch "+strconv.Itoa(batchSize), func(b *testing.B) {
+			_, addr := startServer(b, tcpserver.Config{WriteBatchSize: batchSize, StreamHandler: frames(n)})
+
+			conn := dial(b, addr)
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				b.Fatalf("failed to clear deadline: %v", err)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				conn.send("go\n")
+				for range n {
+					conn.readLine()
+				}
+			}
+		})
+	}
+}
+
+func TestStreamResponseHandler(t *testing.T) {
+	payload := make([]byte, 8<<20)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	_, addr := startServer(t, tcpserver.Config{
+		StreamResponseHandler: func(ctx context.Context, message []byte) (io.Reader, error) {
+			return bytes.NewReader(payload), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for range 2 {
+		conn.send("download\n")
+
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn.reader, got); err != nil {
+			t.Fatalf("failed to read the response: %v", err)
+		}
+
+		if !bytes.Equal(got, payload) {
+			t.Fatal("got a response that differs from the payload")
+		}
+	}
+}
+
+func TestClientClosingBeforeTheResponse(t *testing.T) {
+	var reported atomic.Int64
+	closed := make(chan struct{})
+	disconnected := make(chan struct{}, 2)
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "slow\n" {
+				<-closed
+				time.Sleep(10 * time.Millisecond)
+				return bytes.Repeat([]byte("x"), 1<<20), nil
+			}
+
+			return message, nil
+		},
+		OnError: func(addr net.Addr, stage string, err error) {
+			reported.Add(1)
+		},
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- struct{}{}
+		},
+	})
+
+	// The client resets the connection before the response is written, so the write fails
+	// with a broken pipe or a connection reset.
+	conn := dial(t, addr)
+	conn.send("slow\n")
+	if err := conn.Conn.(*net.TCPConn).SetLinger(0); err != nil {
+		t.Fatalf("failed to set linger: %v", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+	close(closed)
+	<-disconnected
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	if got := reported.Load(); got != 0 {
+		t.Errorf("OnError was called %d times for a connection closed by the client", got)
+	}
+}
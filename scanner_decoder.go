@@ -0,0 +1,88 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ScannerDecoder is a Decoder that splits the stream into tokens with a bufio.SplitFunc, such as bufio.ScanWords,
+// and returns one token per message.
+// Tokens are scanned in place from the reader of the connection, which persists across Decode calls,
+// so the bytes that follow a token are kept for the next one.
+type ScannerDecoder struct {
+	// Split splits the stream into tokens.
+	// If nil, bufio.ScanLines is used.
+	Split bufio.SplitFunc
+
+	// MaxTokenSize is the maximum number of bytes scanned for a single token.
+	// Tokens larger than MaxTokenSize are rejected with ErrMessageTooLarge.
+	// It cannot exceed the buffer size of the reader, set by Config.ReadBufferSize, which is also the limit if zero.
+	MaxTokenSize int
+}
+
+// Decode returns the next token of r.
+// If the stream ends without a complete token, the remaining bytes are discarded and io.EOF is returned.
+// If r is not a *bufio.Reader, it is read one byte at a time and the split function is given one more byte
+// on each call, so the bytes that follow a token are left in r as long as the split function consumes
+// the data it sees up to the token.
+func (d *ScannerDecoder) Decode(r io.Reader) ([]byte, error) {
+	br := bufferReader(r)
+
+	split := d.Split
+	if split == nil {
+		split = bufio.ScanLines
+	}
+
+	maxSize := br.Size()
+	if d.MaxTokenSize > 0 && d.MaxTokenSize < maxSize {
+		maxSize = d.MaxTokenSize
+	}
+
+	n := br.Buffered()
+	for {
+		// Peek blocks until n bytes are buffered, so the split function sees one more byte on each iteration.
+		data, err := br.Peek(n)
+		atEOF := errors.Is(err, io.EOF)
+		if err != nil && !atEOF {
+			return nil, err
+		}
+
+		if len(data) > 0 || atEOF {
+			advance, token, err := split(data, atEOF)
+			if err != nil && !errors.Is(err, bufio.ErrFinalToken) {
+				return nil, err
+			}
+
+			if len(token) > maxSize {
+				return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, maxSize)
+			}
+
+			token = bytes.Clone(token)
+			if _, err := br.Discard(advance); err != nil {
+				return nil, err
+			}
+
+			if token != nil {
+				return token, nil
+			}
+
+			if advance > 0 {
+				n = br.Buffered()
+				continue
+			}
+		}
+
+		if atEOF {
+			return nil, io.EOF
+		}
+
+		if len(data) >= maxSize {
+			return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, maxSize)
+		}
+
+		n = len(data) + 1
+	}
+}
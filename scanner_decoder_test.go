@@ -0,0 +1,72 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestScannerDecoderScanWords(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Decoder: &tcpserver.ScannerDecoder{Split: bufio.ScanWords},
+		Encoder: &tcpserver.DelimiterCodec{},
+	})
+
+	conn := dial(t, addr)
+	conn.send("  one two\tthree\n  fo")
+	conn.send("ur ")
+
+	for _, want := range []string{"one", "two", "three", "four"} {
+		if got := conn.readLine(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestScannerDecoderMaxTokenSize(t *testing.T) {
+	decoder := &tcpserver.ScannerDecoder{Split: bufio.ScanWords, MaxTokenSize: 5}
+	r := bufio.NewReader(strings.NewReader("tiny enormous"))
+
+	// As with a bufio.Scanner, the bytes scanned for a token include the delimiter that ends it.
+
+	if got, err := decoder.Decode(r); err != nil || string(got) != "tiny" {
+		t.Fatalf("got %q and error %v, want %q", got, err, "tiny")
+	}
+
+	if _, err := decoder.Decode(r); !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+}
+
+func TestScannerDecoderEndOfStream(t *testing.T) {
+	decoder := &tcpserver.ScannerDecoder{Split: bufio.ScanWords}
+	r := bufio.NewReader(strings.NewReader("last  "))
+
+	if got, err := decoder.Decode(r); err != nil || string(got) != "last" {
+		t.Fatalf("got %q and error %v, want %q", got, err, "last")
+	}
+
+	if _, err := decoder.Decode(r); !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v, want %v", err, io.EOF)
+	}
+}
+
+func TestScannerDecoderUnbufferedReader(t *testing.T) {
+	decoder := &tcpserver.ScannerDecoder{Split: bufio.ScanWords}
+	r := strings.NewReader("hello world ")
+
+	for _, want := range []string{"hello", "world"} {
+		got, err := decoder.Decode(r)
+		if err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
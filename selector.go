@@ -0,0 +1,29 @@
+package tcpserver
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// selectHandler peeks the first bytes sent on the connection and passes them to the HandlerSelector,
+// bounded by the ReadTimeout if set. The peeked bytes stay in reader for the Decoder.
+func (s *Server) selectHandler(conn net.Conn, reader *bufio.Reader) (Handler, error) {
+	if s.readTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := reader.Peek(1); err != nil {
+		return nil, err
+	}
+
+	peek, _ := reader.Peek(reader.Buffered())
+	handler := s.selector(peek)
+	if handler == nil {
+		return s.handler, nil
+	}
+
+	return chain(handler, s.middlewares...), nil
+}
@@ -0,0 +1,40 @@
+package tcpserver_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestHandlerSelector(t *testing.T) {
+	upper := func(ctx context.Context, message []byte) ([]byte, error) {
+		return bytes.ToUpper(message), nil
+	}
+
+	_, addr := startServer(t, tcpserver.Config{
+		HandlerSelector: func(peek []byte) tcpserver.Handler {
+			if bytes.HasPrefix(peek, []byte("v2")) {
+				return upper
+			}
+
+			return nil
+		},
+	})
+
+	// The peeked bytes are decoded again as part of the first message.
+	v2 := dial(t, addr)
+	if got := v2.roundTrip("v2 hello"); got != "V2 HELLO" {
+		t.Errorf("got %q, want %q", got, "V2 HELLO")
+	}
+
+	if got := v2.roundTrip("again"); got != "AGAIN" {
+		t.Errorf("got %q, want %q", got, "AGAIN")
+	}
+
+	v1 := dial(t, addr)
+	if got := v1.roundTrip("v1 hello"); got != "v1 hello" {
+		t.Errorf("got %q, want %q", got, "v1 hello")
+	}
+}
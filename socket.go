@@ -0,0 +1,156 @@
+package tcpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrReusePortUnsupported is returned by Serve when ReusePort is set on a platform without SO_REUSEPORT.
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+	// ErrBacklogUnsupported is returned by Serve when Backlog is set on a platform where it cannot be changed.
+	ErrBacklogUnsupported = errors.New("listen backlog cannot be set on this platform")
+
+	// ErrAddressInUse is returned by Serve, wrapping the original error, when an address is already in use,
+	// so callers can retry with another address.
+	ErrAddressInUse = errors.New("address already in use")
+
+	// ErrNoListenerFile is returned by ListenerFile when the server is not listening
+	// or its listener is not backed by a file descriptor.
+	ErrNoListenerFile = errors.New("listener has no file")
+)
+
+// listenConfig returns the net.ListenConfig used to create the listeners.
+func (s *Server) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: s.control}
+}
+
+// control sets the socket options before the socket is bound, then calls the ControlFunc if set.
+func (s *Server) control(network, address string, c syscall.RawConn) error {
+	if s.reusePort {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setReusePort(fd)
+		}); err != nil {
+			return err
+		}
+
+		if sockErr != nil {
+			return sockErr
+		}
+	}
+
+	if s.controlFunc != nil {
+		return s.controlFunc(network, address, c)
+	}
+
+	return nil
+}
+
+// listenStream creates a stream listener on address.
+func (s *Server) listenStream(address string) (net.Listener, error) {
+	listener, err := s.listenConfig().Listen(context.Background(), s.network, address)
+	if err != nil {
+		return nil, wrapAddrInUse(err)
+	}
+
+	if s.backlog > 0 {
+		if err := setListenerBacklog(listener, s.backlog); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("set backlog on %s: %w", address, err)
+		}
+	}
+
+	return listener, nil
+}
+
+// setListenerBacklog changes the backlog of an already listening socket.
+// The socket option cannot be set from the Control function because the backlog is passed to listen(2),
+// which runs after it, so listen is called again, which updates the backlog of a listening socket.
+func setListenerBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return ErrBacklogUnsupported
+	}
+
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		listenErr = setBacklog(fd, backlog)
+	}); err != nil {
+		return err
+	}
+
+	return listenErr
+}
+
+// listenPacket creates a packet connection on address.
+func (s *Server) listenPacket(address string) (net.PacketConn, error) {
+	packetConn, err := s.listenConfig().ListenPacket(context.Background(), s.network, address)
+	if err != nil {
+		return nil, wrapAddrInUse(err)
+	}
+
+	return packetConn, nil
+}
+
+// wrapAddrInUse wraps err with ErrAddressInUse if the address is already in use.
+func wrapAddrInUse(err error) error {
+	if isAddrInUse(err) {
+		return fmt.Errorf("%w: %w", ErrAddressInUse, err)
+	}
+
+	return err
+}
+
+// ListenerFile returns a duplicate of the file descriptor of the listener used by the server,
+// so it can be passed to another process, for instance through exec.Cmd.ExtraFiles.
+// When listening on several addresses, it returns the file of the first one.
+// For a graceful restart, use HandoffListener.
+//
+// The returned file is independent of the listener: closing it does not close the listener
+// and vice versa, and the caller is responsible for closing it.
+// It returns ErrNoListenerFile if the listener is not a TCP or Unix listener or packet connection.
+func (s *Server) ListenerFile() (*os.File, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var socket any
+	switch {
+	case len(s.packetConns) > 0:
+		socket = s.packetConns[0]
+	case len(s.listeners) > 0:
+		socket = s.listeners[0]
+	}
+
+	filer, ok := socket.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, ErrNoListenerFile
+	}
+
+	return filer.File()
+}
+
+// HandoffListener exports the listener for a graceful restart, in which a successor process
+// takes over the listening socket while the current server finishes its connections:
+//
+//  1. The current process calls HandoffListener and passes the file to the successor,
+//     for instance through exec.Cmd.ExtraFiles, then closes its copy.
+//  2. The successor adopts it with net.FileListener and sets it as the Config.Listener of its server.
+//  3. Once the successor is serving, the current process calls Drain, so it stops accepting
+//     and returns when its in-flight connections are finished.
+//
+// Until Drain is called, both processes accept connections from the same socket.
+// It is like ListenerFile and returns the same errors.
+func (s *Server) HandoffListener() (*os.File, error) {
+	return s.ListenerFile()
+}
@@ -0,0 +1,99 @@
+package tcpserver_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestReusePort(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Address: "127.0.0.1:0", ReusePort: true, Handler: answer("first")})
+	_, second := startServer(t, tcpserver.Config{Address: addr, ReusePort: true, Handler: answer("second")})
+
+	if second != addr {
+		t.Fatalf("got address %q for the second server, want %q", second, addr)
+	}
+
+	for range 10 {
+		if got := dial(t, addr).roundTrip("hello"); got != "first" && got != "second" {
+			t.Errorf("got %q, want the answer of either server", got)
+		}
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	server, addr := startServer(t, tcpserver.Config{Backlog: 512})
+
+	sendConcurrently(t, "tcp", addr, 100)
+
+	if got := server.Stats().TotalConnections; got != 100 {
+		t.Errorf("got %d connections, want 100", got)
+	}
+}
+
+func TestControlFunc(t *testing.T) {
+	const size = 64 << 10
+
+	server, _ := startServer(t, tcpserver.Config{
+		ControlFunc: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, size)
+			}); controlErr != nil {
+				return controlErr
+			}
+
+			return err
+		},
+	})
+
+	file, err := server.ListenerFile()
+	if err != nil {
+		t.Fatalf("failed to get the listener file: %v", err)
+	}
+	defer file.Close()
+
+	// Fd would put the socket shared with the listener in blocking mode, so it is read through SyscallConn.
+	raw, err := file.SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get the raw connection: %v", err)
+	}
+
+	var got int
+	if controlErr := raw.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	}); controlErr != nil {
+		t.Fatalf("failed to control the socket: %v", controlErr)
+	}
+
+	if err != nil {
+		t.Fatalf("failed to read SO_RCVBUF: %v", err)
+	}
+
+	// Linux doubles the value to account for its bookkeeping overhead.
+
+	if got < size {
+		t.Errorf("got SO_RCVBUF %d, want at least %d", got, size)
+	}
+}
+
+func TestControlFuncError(t *testing.T) {
+	errControl := errors.New("control failed")
+	server := tcpserver.New(tcpserver.Config{
+		Address:             "127.0.0.1:0",
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+		ControlFunc: func(network, address string, c syscall.RawConn) error {
+			return errControl
+		},
+	})
+
+	if err := server.Serve(); !errors.Is(err, errControl) {
+		t.Errorf("got error %v, want %v", err, errControl)
+	}
+}
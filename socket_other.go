@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tcpserver
+
+func setReusePort(fd uintptr) error {
+	return ErrReusePortUnsupported
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return ErrBacklogUnsupported
+}
@@ -0,0 +1,132 @@
+package tcpserver_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// answer returns a Handler that answers every message with name.
+func answer(name string) tcpserver.Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		return []byte(name + "\n"), nil
+	}
+}
+
+func TestHandoffListener(t *testing.T) {
+	current, addr := startServer(t, tcpserver.Config{Handler: answer("current")})
+
+	inFlight := dial(t, addr)
+	if got := inFlight.roundTrip("hello"); got != "current" {
+		t.Fatalf("got %q, want %q", got, "current")
+	}
+
+	file, err := current.HandoffListener()
+	if err != nil {
+		t.Fatalf("failed to get the listener file: %v", err)
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		t.Fatalf("failed to adopt the listener: %v", err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close the listener file: %v", err)
+	}
+
+	_, successorAddr := startServer(t, tcpserver.Config{Listener: listener, Handler: answer("successor")})
+	if successorAddr != addr {
+		t.Fatalf("got successor address %q, want %q", successorAddr, addr)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		drained <- current.Drain(ctx)
+	}()
+
+	// Once the current server stops accepting, new connections are served by the successor.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		conn := dial(t, addr)
+		got := conn.roundTrip("hello")
+		_ = conn.Close()
+
+		if got == "successor" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("new connections were not served by the successor")
+		}
+	}
+
+	// The connection accepted before the handoff is still served until it is closed.
+	if got := inFlight.roundTrip("hello"); got != "current" {
+		t.Errorf("got %q from the in-flight connection, want %q", got, "current")
+	}
+
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned %v before the in-flight connection was closed", err)
+	default:
+	}
+
+	if err := inFlight.Close(); err != nil {
+		t.Fatalf("failed to close the in-flight connection: %v", err)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("failed to drain: %v", err)
+	}
+}
+
+func TestListenerFile(t *testing.T) {
+	server, addr := startServer(t, tcpserver.Config{})
+
+	file, err := server.ListenerFile()
+	if err != nil {
+		t.Fatalf("failed to get the listener file: %v", err)
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		t.Fatalf("got a file that is not a listener: %v", err)
+	}
+	defer listener.Close()
+
+	if got := listener.Addr().String(); got != addr {
+		t.Errorf("got listener address %q, want %q", got, addr)
+	}
+}
+
+func TestListenerFileUnavailable(t *testing.T) {
+	server, _ := startServer(t, tcpserver.Config{Listener: newPipeListener()})
+
+	if _, err := server.ListenerFile(); !errors.Is(err, tcpserver.ErrNoListenerFile) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrNoListenerFile)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Address: "127.0.0.1:0"})
+
+	server := tcpserver.New(tcpserver.Config{
+		Address:             addr,
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	if err := server.Serve(); !errors.Is(err, tcpserver.ErrAddressInUse) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrAddressInUse)
+	}
+}
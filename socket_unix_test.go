@@ -0,0 +1,75 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcpserver
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetSocketOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		want      int
+	}{
+		{name: "keep-alive enabled", keepAlive: 30 * time.Second, want: 1},
+		{name: "keep-alive disabled", keepAlive: -1, want: 0},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer client.Close()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("failed to accept: %v", err)
+			}
+			defer conn.Close()
+
+			server := New(Config{TCPKeepAlive: tt.keepAlive, TCPNoDelay: true})
+			if err := server.setSocketOptions(conn); err != nil {
+				t.Fatalf("failed to set the socket options: %v", err)
+			}
+
+			raw, err := conn.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatalf("failed to get the raw connection: %v", err)
+			}
+
+			var keepAlive, noDelay int
+			if controlErr := raw.Control(func(fd uintptr) {
+				keepAlive, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+				if err == nil {
+					noDelay, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+				}
+			}); controlErr != nil {
+				t.Fatalf("failed to control the socket: %v", controlErr)
+			}
+
+			if err != nil {
+				t.Fatalf("failed to read the socket options: %v", err)
+			}
+
+			if (keepAlive != 0) != (tt.want != 0) {
+				t.Errorf("got SO_KEEPALIVE %d, want %d", keepAlive, tt.want)
+			}
+
+			if noDelay == 0 {
+				t.Error("TCP_NODELAY is not set")
+			}
+		})
+	}
+}
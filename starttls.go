@@ -0,0 +1,46 @@
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrStartTLSUnavailable is returned by StartTLS when the connection cannot be upgraded to TLS.
+var ErrStartTLSUnavailable = errors.New("STARTTLS is not available on this connection")
+
+type startTLSKey struct{}
+
+// StartTLS upgrades the connection that sent the message being handled to TLS using config,
+// as done by protocols with a STARTTLS command.
+// The upgrade takes place once the response to the current message is written, so the command can be answered
+// in plaintext, and the handshake is performed before the next message is read, bounded by the ReadTimeout if set.
+// The following messages are decoded from and encoded to the encrypted connection with the same codec,
+// and TLSState and ClientCert report the state of the negotiated session.
+// If the handshake fails, the connection is closed.
+//
+// It returns ErrStartTLSUnavailable if the connection already uses TLS, is a packet connection,
+// or is served with WebSocket or Compression set.
+func StartTLS(ctx context.Context, config *tls.Config) error {
+	upgrade, ok := ctx.Value(startTLSKey{}).(*atomic.Pointer[tls.Config])
+	if !ok || TLSState(ctx) != nil {
+		return ErrStartTLSUnavailable
+	}
+
+	if config == nil {
+		return errors.New("invalid TLS config: must not be nil")
+	}
+
+	upgrade.Store(config)
+	return nil
+}
+
+// upgradePending returns the config passed to StartTLS while handling the last message, if any.
+func upgradePending(upgrade *atomic.Pointer[tls.Config]) *tls.Config {
+	if upgrade == nil {
+		return nil
+	}
+
+	return upgrade.Swap(nil)
+}
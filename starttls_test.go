@@ -0,0 +1,173 @@
+package tcpserver_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// startTLSHandler upgrades the connection on STARTTLS and answers any other message
+// with whether the connection is encrypted.
+func startTLSHandler(config *tls.Config) tcpserver.Handler {
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		if strings.TrimSpace(string(message)) != "STARTTLS" {
+			if tcpserver.TLSState(ctx) != nil {
+				return []byte("encrypted\n"), nil
+			}
+
+			return []byte("plaintext\n"), nil
+		}
+
+		if err := tcpserver.StartTLS(ctx, config); err != nil {
+			return []byte(err.Error() + "\n"), nil
+		}
+
+		return []byte("READY\n"), nil
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{Handler: startTLSHandler(serverConfig)})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("hello"); got != "plaintext" {
+		t.Errorf("got %q before the upgrade, want %q", got, "plaintext")
+	}
+
+	if got := conn.roundTrip("STARTTLS"); got != "READY" {
+		t.Fatalf("got %q, want %q", got, "READY")
+	}
+
+	tlsConn := conn.upgradeTLS(clientConfig)
+	if got := tlsConn.roundTrip("hello"); got != "encrypted" {
+		t.Errorf("got %q after the upgrade, want %q", got, "encrypted")
+	}
+
+	// A connection that already uses TLS cannot be upgraded again.
+	if got, want := tlsConn.roundTrip("STARTTLS"), tcpserver.ErrStartTLSUnavailable.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := tlsConn.roundTrip("hello"); got != "encrypted" {
+		t.Errorf("got %q, want %q", got, "encrypted")
+	}
+}
+
+func TestStartTLSUnavailableWithTLSConfig(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{TLSConfig: serverConfig, Handler: startTLSHandler(serverConfig)})
+
+	conn := dial(t, addr).upgradeTLS(clientConfig)
+	if got, want := conn.roundTrip("STARTTLS"), tcpserver.ErrStartTLSUnavailable.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStartTLSHandshakeFailureClosesConnection(t *testing.T) {
+	serverConfig, _ := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{Handler: startTLSHandler(serverConfig)})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("STARTTLS"); got != "READY" {
+		t.Fatalf("got %q, want %q", got, "READY")
+	}
+
+	conn.send("not a TLS client hello\n")
+	if _, err := io.Copy(io.Discard, conn.reader); isTimeout(err) {
+		t.Errorf("the connection was not closed after the handshake failed: %v", err)
+	}
+}
+
+// TestBytesAreCountedOnTheWire checks that connections using TLSConfig and StartTLS both count
+// the bytes sent on the wire, including the TLS records.
+func TestBytesAreCountedOnTheWire(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+
+	tests := []struct {
+		name    string
+		cfg     tcpserver.Config
+		upgrade func(conn *testConn) *testConn
+	}{
+		{
+			name: "TLSConfig",
+			cfg:  tcpserver.Config{TLSConfig: serverConfig, Handler: startTLSHandler(serverConfig)},
+			upgrade: func(conn *testConn) *testConn {
+				return conn.upgradeTLS(clientConfig)
+			},
+		},
+		{
+			name: "StartTLS",
+			cfg:  tcpserver.Config{Handler: startTLSHandler(serverConfig)},
+			upgrade: func(conn *testConn) *testConn {
+				if got := conn.roundTrip("STARTTLS"); got != "READY" {
+					conn.t.Fatalf("got %q, want %q", got, "READY")
+				}
+
+				return conn.upgradeTLS(clientConfig)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, addr := startServer(t, tt.cfg)
+
+			raw, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer raw.Close()
+
+			wire := &wireCounter{Conn: raw}
+			conn := tt.upgrade(newTestConn(t, wire))
+			if got := conn.roundTrip("hello"); got != "encrypted" {
+				t.Fatalf("got %q, want %q", got, "encrypted")
+			}
+
+			if err := conn.Conn.(*tls.Conn).CloseWrite(); err != nil {
+				t.Fatalf("failed to close the connection for writing: %v", err)
+			}
+
+			if _, err := io.Copy(io.Discard, wire); err != nil {
+				t.Fatalf("failed to read until the connection is closed: %v", err)
+			}
+
+			waitNoConnections(t, server)
+
+			stats := server.Stats()
+			if got, want := stats.BytesRead, wire.written.Load(); got != want {
+				t.Errorf("got %d bytes read, want the %d bytes written by the client", got, want)
+			}
+
+			if got, want := stats.BytesWritten, wire.read.Load(); got != want {
+				t.Errorf("got %d bytes written, want the %d bytes read by the client", got, want)
+			}
+		})
+	}
+}
+
+// wireCounter counts the bytes exchanged by the client on the underlying connection.
+type wireCounter struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *wireCounter) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *wireCounter) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
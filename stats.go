@@ -0,0 +1,59 @@
+package tcpserver
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Stats holds live counters of the server.
+type Stats struct {
+	// ActiveConnections is the number of connections currently being served.
+	ActiveConnections int64
+
+	// TotalConnections is the number of connections accepted since the server was created.
+	TotalConnections int64
+
+	// TotalMessages is the number of messages decoded since the server was created.
+	TotalMessages int64
+
+	// BytesRead is the number of bytes read from connections since the server was created.
+	// As with ConnBytes, bytes are counted as sent on the wire, including the TLS overhead.
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to connections since the server was created.
+	BytesWritten int64
+}
+
+// Stats returns a snapshot of the server counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ActiveConnections: s.activeConnections.Load(),
+		TotalConnections:  s.totalConnections.Load(),
+		TotalMessages:     s.totalMessages.Load(),
+		BytesRead:         s.bytesRead.Load(),
+		BytesWritten:      s.bytesWritten.Load(),
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection,
+// both for the connection itself and the server totals.
+type countingConn struct {
+	net.Conn
+	server  *Server
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	c.server.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	c.server.bytesWritten.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,62 @@
+package tcpserver_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestStatsConnections(t *testing.T) {
+	const n = 5
+	server, addr := startServer(t, tcpserver.Config{})
+
+	raws := make([]net.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range raws {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			raws[i], errs[i] = net.Dial("tcp", addr)
+		}()
+	}
+	wg.Wait()
+
+	conns := make([]*testConn, n)
+	for i, raw := range raws {
+		if errs[i] != nil {
+			t.Fatalf("failed to dial: %v", errs[i])
+		}
+
+		t.Cleanup(func() { _ = raw.Close() })
+		conns[i] = newTestConn(t, raw)
+		conns[i].roundTrip("hello")
+	}
+
+	stats := server.Stats()
+	if stats.ActiveConnections != n {
+		t.Errorf("got %d active connections, want %d", stats.ActiveConnections, n)
+	}
+
+	if stats.TotalConnections != n {
+		t.Errorf("got %d total connections, want %d", stats.TotalConnections, n)
+	}
+
+	if stats.TotalMessages != n {
+		t.Errorf("got %d total messages, want %d", stats.TotalMessages, n)
+	}
+
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close connection: %v", err)
+		}
+	}
+
+	waitNoConnections(t, server)
+
+	if got := server.Stats().TotalConnections; got != n {
+		t.Errorf("got %d total connections once closed, want %d", got, n)
+	}
+}
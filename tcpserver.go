@@ -1,196 +1,1868 @@
 package tcpserver
 
 import (
+	"bufio"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Decoder is responsible for decoding the stream-based message into a meaningful object.
+// The reader is a *bufio.Reader that persists for the lifetime of the connection,
+// so implementations should read from it directly instead of wrapping it in another buffer.
+// Its methods retry reads that return no data and no error, failing with io.ErrNoProgress if they persist,
+// so decoders built on them, such as ReadMessage, do not need to handle them.
 type Decoder interface {
 	Decode(reader io.Reader) ([]byte, error)
 }
 
 // Encoder is responsible for encoding the Handler message back to the client.
+// Encode errors are fatal: nothing else is written to the connection, which is closed
+// and the error is passed to OnDisconnect.
 type Encoder interface {
 	Encode(writer io.Writer, p []byte) error
 }
 
 // The Handler type allows clients to process incoming tcp connections.
-// The provided context is canceled on Shutdown.
+// The provided context is canceled on Shutdown, and as soon as the client closes the connection
+// while the Handler runs, unless Compression or a ReadAllDecoder is used.
+// It carries the remote address of the connection, which can be retrieved with RemoteAddr.
+// If the returned response is nil, nothing is written back to the client, whereas an empty
+// non-nil response is passed to the Encoder, which may write an empty frame.
 type Handler func(ctx context.Context, message []byte) ([]byte, error)
 
+var (
+	// ErrServerClosing is returned by Serve when the server is shutting down or was shut down.
+	ErrServerClosing = errors.New("server is already closing")
+
+	// ErrServerRunning is returned by Serve and Reset when the server is already running.
+	ErrServerRunning = errors.New("server is already running")
+
+	// ErrNoHandler is returned by Serve when no Handler is set and AllowDefaultHandler is false.
+	ErrNoHandler = errors.New("no handler configured")
+)
+
+// ErrCloseConnection can be returned by a Handler alongside a response to close the connection
+// once the response is written. It is not treated as an error.
+var ErrCloseConnection = errors.New("close connection")
+
+// ErrIdleTimeout is the error passed to OnDisconnect when a connection is closed
+// because no message was received within the IdleTimeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrHandlerTimeout is the error passed to OnDisconnect when a connection is closed
+// because the Handler exceeded the HandlerTimeout and the TimeoutResponse was written.
+var ErrHandlerTimeout = errors.New("handler timeout")
+
+// ErrActivityTimeout is the error passed to OnDisconnect when a connection is closed
+// because nothing was read or written within the ActivityTimeout.
+var ErrActivityTimeout = errors.New("activity timeout")
+
+// NoopListenerAddrFunc is a ListenerAddrFunc that does nothing.
+// It can be used to disable the default listener address logging.
+var NoopListenerAddrFunc = func(addr net.Addr) {}
+
 // Server is a TCP server that listens on a TCP network address and
 // invokes the Handler for each incoming connection.
 type Server struct {
-	address          string
+	network          string
+	customListener   net.Listener
+	addresses        []string
 	handler          Handler
+	streamHandler    StreamHandler
+	packetHandler    Handler
+	selector         func(peek []byte) Handler
+	middlewares      []Middleware
+	defaultHandler   bool
+	allowDefault     bool
 	decoder          Decoder
+	frameDecoder     FrameDecoder
 	encoder          Encoder
 	listenerAddrFunc func(addr net.Addr)
+	disableKeepAlive bool
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	readBufferSize   int
+	writeBufferSize  int
+	writeBatchSize   int
+	writeBatchWindow time.Duration
+	writeQueueSize   int
+	writeQueuePolicy WriteQueuePolicy
+	idleTimeout      time.Duration
+	activityTimeout  time.Duration
+	tcpKeepAlive     time.Duration
+	tcpNoDelay       bool
+	handlerTimeout   time.Duration
+	timeoutResponse  []byte
+	skipEmpty        bool
+	maxWorkers       int
+	sequential       bool
+	proxyProtocol    bool
+	connFilter       func(remote net.Addr) bool
+	perIPLimit       int
+	perSubnetLimit   int
+	subnetBitsIPv4   int
+	subnetBitsIPv6   int
+	maxAccepts       int64
+	reusePort        bool
+	controlFunc      func(network, address string, c syscall.RawConn) error
+	backlog          int
+	compression      Compression
+	webSocket        bool
+	maxMessageSize   int
+	closeFunc        func(conn net.Conn) error
+	errorEncoder     func(ctx context.Context, err error) []byte
+	correlationFunc  func(message []byte) (id []byte, rest []byte)
+	interceptor      func(ctx context.Context, req, resp []byte) ([]byte, error)
+	connSem          chan struct{}
+	recent           *recentBuffer
+	panicHandler     func(addr net.Addr, v any)
+	logger           *slog.Logger
+	logLevel         slog.Level
+	onConnect        func(ctx context.Context, addr net.Addr)
+	onDisconnect     func(addr net.Addr, err error)
+	onMessage        func(addr net.Addr, size int, dur time.Duration, err error)
+	onAcceptError    func(err error) bool
+	onListen         func(addr net.Addr) error
+	onServe          func(addr net.Addr)
+	onShutdown       func()
+	onError          func(addr net.Addr, stage string, err error)
+	tlsConfig        *tls.Config
+	clock            clock
 
 	wg        sync.WaitGroup
 	isClosing atomic.Bool
 
-	mux      sync.Mutex
-	listener net.Listener
+	activeConnections atomic.Int64
+	accepted          atomic.Int64
+	totalConnections  atomic.Int64
+	totalMessages     atomic.Int64
+	bytesRead         atomic.Int64
+	bytesWritten      atomic.Int64
+
+	// seqMux serializes the connections when Sequential is set, across all the listeners.
+	seqMux sync.Mutex
+
+	ipMux       sync.Mutex
+	ipConns     map[netip.Addr]int
+	subnetConns map[netip.Prefix]int
+
+	mux         sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	conns       map[net.Conn]struct{}
+	ready       chan struct{}
+	done        chan struct{}
+	serveErr    error
+	stopped     chan struct{}
 
+	parent    context.Context
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 }
 
 // Config is the configuration of the server. If a field is not set, a default value is used.
 type Config struct {
-	// Address is the TCP address to listen on.
+	// Network is the network to listen on, as accepted by net.Listen.
+	// Use "unix" to listen on a Unix domain socket, in which case Address is the socket path.
+	// The socket file is removed on Shutdown.
+	// Use "udp", "udp4", "udp6" or "unixgram" to serve datagrams with net.ListenPacket,
+	// in which case each datagram is decoded as a single message and the response is sent back to its source.
+	// By default, it listens on "tcp".
+	Network string
+
+	// Address is the address to listen on.
 	// By default, it listens on a random port on localhost.
+	// When the port is 0, the system picks one; use WaitAddr or Addr to learn it.
 	Address string
 
-	// Handler to invoke. If nil, the server echoes the message back to the client.
+	// Addresses to listen on instead of Address, for instance to listen on both IPv4 and IPv6.
+	// Connections accepted on any of them are served by the same pipeline.
+	Addresses []string
+
+	// ReusePort sets SO_REUSEPORT on the listening sockets, so several processes can listen on the same port
+	// and the kernel balances connections between them. Serve returns ErrReusePortUnsupported
+	// on platforms without SO_REUSEPORT.
+	ReusePort bool
+
+	// ControlFunc is called with each listening socket before it is bound, after ReusePort is applied,
+	// to set socket options such as SO_BINDTODEVICE, as the Control function of a net.ListenConfig.
+	// If it returns an error, Serve returns it. It does not apply to a custom Listener.
+	ControlFunc func(network, address string, c syscall.RawConn) error
+
+	// Backlog is the maximum length of the queue of pending connections of the listening sockets.
+	// The system may cap it, for instance to net.core.somaxconn on Linux.
+	// If zero, the system default is used. Serve returns ErrBacklogUnsupported on platforms where it cannot be set.
+	// It does not apply to a custom Listener.
+	Backlog int
+
+	// Listener is used to accept connections instead of listening on Network and Address,
+	// for instance for socket activation or in-memory transports. It is closed on Shutdown.
+	// The socket file of a Unix listener is only removed if the listener unlinks it on close,
+	// which is the default for net.Listen but not for net.FileListener; see net.UnixListener.SetUnlinkOnClose.
+	// A listener exported by HandoffListener in another process can be adopted with net.FileListener.
+	Listener net.Listener
+
+	// Handler to invoke. If nil, the server echoes the message back to the client
+	// as long as AllowDefaultHandler is set; otherwise Serve returns ErrNoHandler.
 	Handler Handler
 
+	// AllowDefaultHandler allows serving with the default echo Handler when no Handler is set.
+	// A warning is logged when the server starts with it.
+	AllowDefaultHandler bool
+
+	// StreamHandler to invoke instead of Handler, for protocols that write several responses per message.
+	// Middleware is not applied to it.
+	StreamHandler StreamHandler
+
+	// StreamResponseHandler to invoke instead of Handler, for responses too large to be held in memory.
+	// It is ignored if StreamHandler is set. Middleware is not applied to it.
+	StreamResponseHandler StreamResponseHandler
+
+	// PacketHandler to invoke instead of Handler for packet networks, with the source address of each datagram.
+	// A non-nil response is written back to src. Middleware is applied to it.
+	PacketHandler func(ctx context.Context, src net.Addr, message []byte) ([]byte, error)
+
+	// HandlerSelector chooses the Handler of each connection from the first bytes it sends,
+	// for protocols negotiated on connect. The peeked bytes are not consumed, so the Decoder reads them again.
+	// If it returns nil, the Handler is used. Middleware is applied to the returned Handler.
+	// It is ignored if StreamHandler or StreamResponseHandler is set.
+	HandlerSelector func(peek []byte) Handler
+
+	// Middleware wraps the Handler in order, so the first middleware is the first to run.
+	Middleware []Middleware
+
 	// Decoder used to decode incoming messages that are forwarded to the Handler.
 	// If nil, it will use a new line decoder.
 	Decoder Decoder
 
+	// FrameDecoder is used instead of Decoder for protocols whose messages have a header and a body.
+	// The body is the message seen by the Handler, or the FrameHandler receives the whole frame.
+	FrameDecoder FrameDecoder
+
+	// FrameHandler to invoke instead of Handler, with the frame decoded by the FrameDecoder.
+	// Middleware is applied to it.
+	FrameHandler FrameHandler
+
+	// MaxMessageSize is the maximum size in bytes of a message read by the default new line decoder,
+	// including the delimiter. Larger messages are rejected with ErrMessageTooLarge and the connection is closed.
+	// It is ignored when a custom Decoder is set. If zero, there is no limit.
+	MaxMessageSize int
+
 	// Encoder used to encode the message back to the client.
 	// If nil, it will write the message as is.
 	Encoder Encoder
 
 	// ListenerFunc allows accessing the listener before the server starts serving.
 	// It is called synchronously.
-	// By default, it logs the listener address.
+	// By default, it logs the listener address. Use NoopListenerAddrFunc to disable it.
 	ListenerAddrFunc func(addr net.Addr)
+
+	// DisableKeepAlive closes the connection after the first message is handled.
+	// By default, the server keeps reading messages from the connection until the client closes it.
+	DisableKeepAlive bool
+
+	// ReadTimeout is the maximum duration for reading a message from the connection.
+	// The resulting deadline is also carried by the Handler context, along with the HandlerTimeout,
+	// so the Handler must return within ReadTimeout of the start of reading its message.
+	// If zero, there is no timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum duration for writing a response to the connection.
+	// If zero, there is no timeout.
+	WriteTimeout time.Duration
+
+	// ReadBufferSize is the size of the buffered reader passed to the Decoder, which persists for the lifetime of the connection.
+	// A larger buffer reduces the number of reads for large messages, and bounds the tokens of a ScannerDecoder.
+	// If zero, the bufio default of 4096 bytes is used.
+	ReadBufferSize int
+
+	// WriteBufferSize is the size of the buffer used to write responses to the connection.
+	// When set, the Encoder writes to a buffered writer that is flushed after each message.
+	// If zero, the Encoder writes directly to the connection.
+	WriteBufferSize int
+
+	// WriteBatchSize is the number of responses written by a StreamHandler that are buffered
+	// before being flushed to the connection. Pending responses are always flushed when the handler returns.
+	// If zero or one, each response is flushed as soon as it is written.
+	WriteBatchSize int
+
+	// WriteBatchWindow is the maximum duration a response written by a StreamHandler stays buffered
+	// before being flushed to the connection.
+	// If zero, responses are only flushed by WriteBatchSize or when the handler returns.
+	WriteBatchWindow time.Duration
+
+	// WriteQueueSize is the number of responses queued per connection and written by a dedicated goroutine,
+	// so a StreamHandler is not blocked by a client that reads slowly.
+	// Responses are encoded once dequeued, so their content must not be modified after they are written.
+	// If zero, responses are written by the handler goroutine.
+	WriteQueueSize int
+
+	// WriteQueuePolicy is what happens when the write queue is full. By default, writes block until there is room.
+	WriteQueuePolicy WriteQueuePolicy
+
+	// IdleTimeout is the maximum duration to wait for the next message once the previous one was handled.
+	// Unlike ReadTimeout, it only bounds the time between messages, not the time to read a message.
+	// If zero, there is no timeout.
+	IdleTimeout time.Duration
+
+	// ActivityTimeout closes connections on which nothing was read or written for the given duration.
+	// Unlike IdleTimeout, it is checked on every read and write, so it also applies while a message
+	// is being read or responses are being streamed. It does not extend the ReadTimeout and the WriteTimeout.
+	// If zero, there is no timeout.
+	ActivityTimeout time.Duration
+
+	// TCPKeepAlive is the keep-alive period of accepted TCP connections.
+	// If zero, keep-alives are enabled with the Go default period. If negative, keep-alives are disabled.
+	// It is ignored for non-TCP connections.
+	TCPKeepAlive time.Duration
+
+	// TCPNoDelay disables Nagle's algorithm on accepted TCP connections.
+	// Go already disables it by default, so setting it only guarantees the behavior regardless of the platform default.
+	// It is ignored for non-TCP connections.
+	TCPNoDelay bool
+
+	// Compression compresses the stream of every connection in both directions.
+	// It is applied after the PROXY protocol header and the TLS handshake, before the Decoder and the Encoder,
+	// and responses are flushed through the compressor as soon as they are written.
+	// Clients must use the same Compression. It does not apply to packet networks.
+	Compression Compression
+
+	// WebSocket serves connections over the WebSocket protocol, for clients such as browsers.
+	// The server answers the HTTP upgrade handshake of each connection, after the PROXY protocol header and the TLS handshake,
+	// then decodes each WebSocket message as one message and sends each response as a single frame of the same type,
+	// so the Decoder, the FrameDecoder and the Encoder are not used. The MaxMessageSize, if set, bounds each message.
+	// Ping frames are answered with a pong, and a close frame is answered before the connection is closed cleanly.
+	// It does not apply to packet networks.
+	WebSocket bool
+
+	// CloseFunc closes each connection once it is served, instead of calling its Close method,
+	// for instance to set SO_LINGER or send a goodbye frame first. It must close the connection.
+	// It receives the accepted connection, or the *tls.Conn built on top of it once the TLS handshake of TLSConfig is done.
+	// It is called exactly once per connection, even if the connection was already closed on Shutdown.
+	CloseFunc func(conn net.Conn) error
+
+	// ErrorEncoder returns the response sent to the client when the Handler returns an error
+	// other than ErrCloseConnection, so the client gets an error frame instead of silence.
+	// The response is passed to the Encoder and the connection keeps being served;
+	// if it is nil, nothing is written. If ErrorEncoder is nil, nothing is written and the connection is closed.
+	ErrorEncoder func(ctx context.Context, err error) []byte
+
+	// HandlerTimeout is the maximum duration of a single Handler invocation.
+	// When set, the Handler context is canceled once the timeout elapses and the overrun is logged.
+	// If zero, there is no timeout.
+	HandlerTimeout time.Duration
+
+	// TimeoutResponse is written to the client as soon as the Handler exceeds the deadline of its context,
+	// set by the HandlerTimeout or the ReadTimeout,
+	// without waiting for it to return, and the connection is then closed with ErrHandlerTimeout.
+	// The response the Handler eventually returns is discarded. On packet networks, it is sent as the reply.
+	// It is ignored when StreamHandler or StreamResponseHandler is set. If nil, no response is written.
+	TimeoutResponse []byte
+
+	// SkipEmptyMessages drops decoded messages of zero length without invoking the Handler.
+	// The default new line decoder and a DelimiterCodec with KeepDelimiter return messages with their delimiter,
+	// so a message made only of the delimiter, such as a bare "\n", is considered empty and dropped too.
+	SkipEmptyMessages bool
+
+	// MaxWorkers is the number of goroutines serving connections, or datagrams for packet networks.
+	// When set, accepted connections and received datagrams are queued to a fixed pool of workers
+	// and Serve stops accepting or reading while the queue is full.
+	// If zero, each connection or datagram is served in its own goroutine.
+	MaxWorkers int
+
+	// Sequential serves connections one at a time on the accept loop, or datagrams on the read loop
+	// for packet networks, so handlers never run concurrently and shared state needs no locking.
+	// The next connection is not accepted until the current one is closed, so throughput is limited
+	// to a single client and a slow or idle client blocks every other one; consider an IdleTimeout.
+	// It is ignored if MaxWorkers is set.
+	Sequential bool
+
+	// ProxyProtocol enables parsing a PROXY protocol v1 or v2 header at the start of each connection,
+	// so RemoteAddr reports the address of the client behind a load balancer.
+	// When TLSConfig is set, the header is read in plaintext before the TLS handshake.
+	// Connections with a missing or malformed header are closed.
+	ProxyProtocol bool
+
+	// ConnFilter accepts or rejects each connection based on its remote address, as a simple firewall.
+	// When it returns false, the connection is closed immediately, before the connection limits are checked
+	// and without invoking the Decoder or the Handler. When ProxyProtocol is set, it receives the address
+	// carried by the PROXY protocol header. It does not apply to packet networks.
+	ConnFilter func(remote net.Addr) bool
+
+	// PerIPConnectionLimit is the maximum number of concurrent connections from a single IP address.
+	// Connections over the limit are closed immediately.
+	// If zero, there is no limit.
+	PerIPConnectionLimit int
+
+	// PerSubnetConnectionLimit is the maximum number of concurrent connections from a single subnet,
+	// as determined by SubnetPrefixIPv4 and SubnetPrefixIPv6.
+	// Connections over the limit are closed immediately.
+	// If zero, there is no limit.
+	PerSubnetConnectionLimit int
+
+	// SubnetPrefixIPv4 is the prefix length of the IPv4 subnets counted by PerSubnetConnectionLimit.
+	// If zero, it defaults to 24.
+	SubnetPrefixIPv4 int
+
+	// SubnetPrefixIPv6 is the prefix length of the IPv6 subnets counted by PerSubnetConnectionLimit.
+	// If zero, it defaults to 64.
+	SubnetPrefixIPv6 int
+
+	// CorrelationExtractor splits each decoded message into a correlation ID and the rest of the message,
+	// which is what the Handler receives. The ID is included in the server's log lines as "correlation_id"
+	// and can be retrieved by the Handler with CorrelationID.
+	CorrelationExtractor func(message []byte) (id []byte, rest []byte)
+
+	// ResponseInterceptor is called with each message and the response returned by the Handler,
+	// before the response is encoded. The returned bytes are written instead; if they are nil, nothing is written.
+	// Returning an error aborts the write and closes the connection.
+	// It is not called for nil responses nor for the responses written by a StreamHandler.
+	ResponseInterceptor func(ctx context.Context, req, resp []byte) ([]byte, error)
+
+	// MaxAcceptCount is the number of connections to accept before the server stops accepting,
+	// for load tests and one-shot tools. Once the last one is accepted, the listener is closed
+	// and Serve returns, while the accepted connections keep being served as with Drain.
+	// If zero, there is no limit.
+	MaxAcceptCount int
+
+	// MaxConnections is the maximum number of connections served concurrently.
+	// When the limit is reached, the server stops accepting new connections until one is closed.
+	// If zero, there is no limit.
+	MaxConnections int
+
+	// PanicHandler is called when the Handler, or any callback serving a connection such as the ConnFilter,
+	// panics, with the remote address of the connection and the recovered value.
+	// The panic is always logged and the connection is closed.
+	// If nil, the panic is only logged.
+	PanicHandler func(addr net.Addr, v any)
+
+	// Logger used by the server.
+	// If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// LogLevel is the level of the lifecycle messages logged by the server, such as
+	// "server listening", "connection closed by client" or timeouts. Errors are always logged at error level.
+	// By default, they are logged at info level.
+	LogLevel slog.Level
+
+	// TLSConfig enables TLS when set. The handshake is performed once the connection is admitted,
+	// after the PROXY protocol header, which load balancers send in plaintext, and the ConnFilter and connection limits.
+	// It is bounded by the ReadTimeout if set.
+	TLSConfig *tls.Config
+
+	// OnConnect is called once a connection is admitted, with the context passed to the Handler.
+	// It runs after the PROXY protocol header is read, the ConnFilter, PerIPConnectionLimit and
+	// PerSubnetConnectionLimit accept the connection, the TLS handshake completes and the WebSocket upgrade succeeds.
+	// It is never called for a connection rejected by any of these steps, and neither is OnDisconnect.
+	// It runs synchronously in the connection goroutine.
+	OnConnect func(ctx context.Context, addr net.Addr)
+
+	// OnDisconnect is called when the connection is about to be closed, with the error that terminated it.
+	// The error is nil if the client closed the connection cleanly.
+	// It runs synchronously in the connection goroutine.
+	OnDisconnect func(addr net.Addr, err error)
+
+	// OnMessage is called after each Handler invocation with the size of the decoded message,
+	// the time spent in the Handler and the error it returned, if any.
+	// It runs synchronously in the connection goroutine.
+	OnMessage func(addr net.Addr, size int, dur time.Duration, err error)
+
+	// OnAcceptError is called when accepting a connection fails for a reason other than the server closing.
+	// Returning true keeps accepting after a backoff delay, returning false makes Serve return the error.
+	// If nil, temporary errors and running out of file descriptors (EMFILE, ENFILE) are retried.
+	OnAcceptError func(err error) bool
+
+	// RecentBufferSize is the number of recently handled messages kept in memory for debugging,
+	// which are returned by RecentMessages. Each record keeps at most the first 64 bytes of the message.
+	// If zero, no messages are kept.
+	RecentBufferSize int
+
+	// OnListen is called with the address of each listener once it is bound, before ListenerAddrFunc and OnServe,
+	// for instance to register the address with service discovery.
+	// If it returns an error, Serve closes the listeners and returns the error without accepting any connection.
+	OnListen func(addr net.Addr) error
+
+	// OnServe is called with the address of each listener once it is bound, before connections are accepted.
+	// Unlike ListenerAddrFunc, which defaults to logging the address, it is meant as a readiness signal.
+	OnServe func(addr net.Addr)
+
+	// OnShutdown is called once the server is shut down and all the connections have finished.
+	// Shutdown and Drain return after it does, unless their context is done first.
+	OnShutdown func()
+
+	// OnError is called instead of logging when decoding a message, handling it or encoding a response fails,
+	// with the stage that failed: "decode", "handle" or "encode".
+	// Timeouts and connections closed by the client are not reported, since they are not failures.
+	OnError func(addr net.Addr, stage string, err error)
 }
 
 // New creates a new Server with the given config.
 func New(config ...Config) *Server {
+	return NewWithContext(context.Background(), config...)
+}
+
+// NewWithContext creates a new Server with the given config whose Handler context derives from parent.
+// When parent is canceled, the server shuts down as if Shutdown was called.
+func NewWithContext(parent context.Context, config ...Config) *Server {
 	cfg := defaultConfig(config...)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
+
+	var connSem chan struct{}
+	if cfg.MaxConnections > 0 {
+		connSem = make(chan struct{}, cfg.MaxConnections)
+	}
+
+	var recent *recentBuffer
+	if cfg.RecentBufferSize > 0 {
+		recent = newRecentBuffer(cfg.RecentBufferSize)
+	}
+
+	handler := cfg.Handler
+	if cfg.FrameHandler != nil {
+		handler = fromFrameHandler(cfg.FrameHandler)
+	}
+
+	var packetHandler Handler
+	if cfg.PacketHandler != nil {
+		packetHandler = chain(fromPacketHandler(cfg.PacketHandler), cfg.Middleware...)
+	}
+
+	streamHandler := cfg.StreamHandler
+	if streamHandler == nil && cfg.StreamResponseHandler != nil {
+		streamHandler = streamResponse(cfg.StreamResponseHandler)
+	}
+
 	return &Server{
-		address:          cfg.Address,
-		handler:          cfg.Handler,
+		network:          cfg.Network,
+		customListener:   cfg.Listener,
+		addresses:        cfg.Addresses,
+		handler:          chain(handler, cfg.Middleware...),
+		streamHandler:    streamHandler,
+		packetHandler:    packetHandler,
+		selector:         cfg.HandlerSelector,
+		middlewares:      cfg.Middleware,
+		defaultHandler:   streamHandler == nil && packetHandler == nil && cfg.FrameHandler == nil && (len(config) == 0 || config[0].Handler == nil),
+		allowDefault:     cfg.AllowDefaultHandler,
 		decoder:          cfg.Decoder,
+		frameDecoder:     cfg.FrameDecoder,
 		encoder:          cfg.Encoder,
 		listenerAddrFunc: cfg.ListenerAddrFunc,
+		disableKeepAlive: cfg.DisableKeepAlive,
+		readTimeout:      cfg.ReadTimeout,
+		writeTimeout:     cfg.WriteTimeout,
+		readBufferSize:   cfg.ReadBufferSize,
+		writeBufferSize:  cfg.WriteBufferSize,
+		writeBatchSize:   cfg.WriteBatchSize,
+		writeBatchWindow: cfg.WriteBatchWindow,
+		writeQueueSize:   cfg.WriteQueueSize,
+		writeQueuePolicy: cfg.WriteQueuePolicy,
+		idleTimeout:      cfg.IdleTimeout,
+		activityTimeout:  cfg.ActivityTimeout,
+		tcpKeepAlive:     cfg.TCPKeepAlive,
+		tcpNoDelay:       cfg.TCPNoDelay,
+		handlerTimeout:   cfg.HandlerTimeout,
+		timeoutResponse:  cfg.TimeoutResponse,
+		skipEmpty:        cfg.SkipEmptyMessages,
+		maxWorkers:       cfg.MaxWorkers,
+		sequential:       cfg.Sequential,
+		proxyProtocol:    cfg.ProxyProtocol,
+		connFilter:       cfg.ConnFilter,
+		perIPLimit:       cfg.PerIPConnectionLimit,
+		perSubnetLimit:   cfg.PerSubnetConnectionLimit,
+		subnetBitsIPv4:   cfg.SubnetPrefixIPv4,
+		subnetBitsIPv6:   cfg.SubnetPrefixIPv6,
+		maxAccepts:       int64(cfg.MaxAcceptCount),
+		reusePort:        cfg.ReusePort,
+		controlFunc:      cfg.ControlFunc,
+		backlog:          cfg.Backlog,
+		compression:      cfg.Compression,
+		webSocket:        cfg.WebSocket,
+		maxMessageSize:   cfg.MaxMessageSize,
+		closeFunc:        cfg.CloseFunc,
+		errorEncoder:     cfg.ErrorEncoder,
+		correlationFunc:  cfg.CorrelationExtractor,
+		interceptor:      cfg.ResponseInterceptor,
+		connSem:          connSem,
+		recent:           recent,
+		panicHandler:     cfg.PanicHandler,
+		logger:           cfg.Logger,
+		logLevel:         cfg.LogLevel,
+		tlsConfig:        cfg.TLSConfig,
+		clock:            realClock{},
+		onConnect:        cfg.OnConnect,
+		onDisconnect:     cfg.OnDisconnect,
+		onMessage:        cfg.OnMessage,
+		onAcceptError:    cfg.OnAcceptError,
+		onListen:         cfg.OnListen,
+		onServe:          cfg.OnServe,
+		onShutdown:       cfg.OnShutdown,
+		onError:          cfg.OnError,
 
-		ctx:       ctx,
-		ctxCancel: cancel,
+		ipConns:     make(map[netip.Addr]int),
+		subnetConns: make(map[netip.Prefix]int),
+		conns:       make(map[net.Conn]struct{}),
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		parent:      parent,
+		ctx:         ctx,
+		ctxCancel:   cancel,
 	}
 }
 
 // Serve starts the server and blocks until the server is closed.
+// When listening on several addresses, a listener that fails does not stop the others:
+// Serve returns the first error once all of them have stopped.
 func (s *Server) Serve() error {
-	if s.isClosing.Load() {
-		return errors.New("server is already closing")
+	if s.defaultHandler {
+		if !s.allowDefault {
+			s.mux.Lock()
+			s.failLocked(ErrNoHandler)
+			s.mux.Unlock()
+
+			return ErrNoHandler
+		}
+
+		s.logger.Warn("no handler configured, echoing messages back to the client")
 	}
 
+	// Shut down once the parent context of NewWithContext is canceled.
+	defer context.AfterFunc(s.parent, s.Shutdown)()
+
 	s.mux.Lock()
-	if s.listener != nil {
+	if s.isClosing.Load() {
+		s.mux.Unlock()
+		return ErrServerClosing
+	}
+
+	if len(s.listeners) > 0 || len(s.packetConns) > 0 {
+		s.mux.Unlock()
+		return ErrServerRunning
+	}
+
+	// A previous Serve failed before listening: wait for this one instead.
+	if s.serveErr != nil {
+		s.done = make(chan struct{})
+		s.serveErr = nil
+	}
+
+	if s.customListener == nil && isPacketNetwork(s.network) {
+		packetConns, err := s.listenPackets()
+		if err != nil {
+			s.failLocked(err)
+			s.mux.Unlock()
+			return err
+		}
+
+		addrs := make([]net.Addr, 0, len(packetConns))
+		for _, packetConn := range packetConns {
+			addrs = append(addrs, packetConn.LocalAddr())
+		}
+
+		if err := s.listening(addrs); err != nil {
+			closeAll(packetConns)
+			s.failLocked(err)
+			s.mux.Unlock()
+			return err
+		}
+
+		s.packetConns = packetConns
+
+		close(s.ready)
+		ctx := s.ctx
 		s.mux.Unlock()
-		return errors.New("server is already running")
+
+		var datagrams chan datagram
+		if s.maxWorkers > 0 {
+			datagrams = make(chan datagram, s.maxWorkers)
+			defer close(datagrams)
+
+			s.wg.Add(s.maxWorkers)
+			for range s.maxWorkers {
+				go func() {
+					defer s.wg.Done()
+
+					for d := range datagrams {
+						s.servePacket(ctx, d.conn, d.addr, d.data)
+					}
+				}()
+			}
+		}
+
+		return s.closing(serveAll(packetConns, func(packetConn net.PacketConn) error {
+			return s.servePackets(ctx, packetConn, datagrams)
+		}))
 	}
 
-	listener, err := net.Listen("tcp", s.address)
+	listeners, err := s.listen()
 	if err != nil {
+		s.failLocked(err)
 		s.mux.Unlock()
 		return err
 	}
 
-	s.listener = listener
+	addrs := make([]net.Addr, 0, len(listeners))
+	for _, listener := range listeners {
+		addrs = append(addrs, listener.Addr())
+	}
 
-	if s.listenerAddrFunc != nil {
-		s.listenerAddrFunc(listener.Addr())
+	if err := s.listening(addrs); err != nil {
+		closeAll(listeners)
+		s.failLocked(err)
+		s.mux.Unlock()
+		return err
 	}
 
+	s.listeners = listeners
+
+	close(s.ready)
+	ctx := s.ctx
 	s.mux.Unlock()
 
+	var conns chan net.Conn
+	if s.maxWorkers > 0 {
+		conns = make(chan net.Conn, s.maxWorkers)
+		defer close(conns)
+
+		s.wg.Add(s.maxWorkers)
+		for range s.maxWorkers {
+			go func() {
+				defer s.wg.Done()
+
+				for conn := range conns {
+					s.serve(ctx, conn)
+					s.releaseConn()
+				}
+			}()
+		}
+	}
+
+	return s.closing(serveAll(listeners, func(listener net.Listener) error {
+		return s.accept(ctx, listener, conns)
+	}))
+}
+
+// listening reports the addresses the server is listening on to OnListen, then to ListenerAddrFunc and OnServe.
+// If OnListen returns an error, nothing else is reported and the error is returned.
+func (s *Server) listening(addrs []net.Addr) error {
+	if s.onListen != nil {
+		for _, addr := range addrs {
+			if err := s.onListen(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		if s.listenerAddrFunc != nil {
+			s.listenerAddrFunc(addr)
+		}
+
+		if s.onServe != nil {
+			s.onServe(addr)
+		}
+	}
+
+	return nil
+}
+
+// closing logs that the server is closing if Serve returns without error.
+func (s *Server) closing(err error) error {
+	if err == nil {
+		s.logger.Log(context.Background(), s.logLevel, "server is closing")
+	}
+
+	return err
+}
+
+// listen creates the listeners, or uses the injected one.
+// If a listener cannot be created, the ones already created are closed.
+func (s *Server) listen() ([]net.Listener, error) {
+	if s.customListener != nil {
+		return []net.Listener{s.customListener}, nil
+	}
+
+	listeners := make([]net.Listener, 0, len(s.addresses))
+	for _, address := range s.addresses {
+		listener, err := s.listenStream(address)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// listenPackets creates a packet connection for each address.
+// If a connection cannot be created, the ones already created are closed.
+func (s *Server) listenPackets() ([]net.PacketConn, error) {
+	packetConns := make([]net.PacketConn, 0, len(s.addresses))
+	for _, address := range s.addresses {
+		packetConn, err := s.listenPacket(address)
+		if err != nil {
+			closeAll(packetConns)
+			return nil, err
+		}
+
+		packetConns = append(packetConns, packetConn)
+	}
+
+	return packetConns, nil
+}
+
+func closeAll[T io.Closer](closers []T) {
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+}
+
+// serveAll runs serve for each item concurrently and waits for all of them to return.
+// It returns the first error.
+func serveAll[T any](items []T, serve func(T) error) error {
+	errs := make([]error, len(items))
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			errs[i] = serve(item)
+		}()
+	}
+
+	wg.Wait()
+
+	return cmp.Or(errs...)
+}
+
+// accept accepts connections from the listener until it is closed or MaxAcceptCount connections are accepted.
+// Connections are sent to conns if the worker pool is enabled, or served in their own goroutine otherwise.
+func (s *Server) accept(ctx context.Context, listener net.Listener, conns chan<- net.Conn) error {
+	var retryDelay time.Duration
 	for {
+		if !s.acquireConn(ctx) {
+			return nil
+		}
+
 		conn, err := listener.Accept()
 		if err != nil {
+			s.releaseConn()
 			if s.isClosing.Load() {
-				slog.Info("server is closing")
 				return nil
 			}
 
+			if s.retryAccept(err) {
+				retryDelay = nextRetryDelay(retryDelay)
+				s.logger.Warn("failed to accept connection, retrying", "error", err, "delay", retryDelay)
+
+				if !s.sleep(ctx, retryDelay) {
+					return nil
+				}
+
+				continue
+			}
+
 			return err
 		}
 
+		retryDelay = 0
+
+		if err := s.setSocketOptions(conn); err != nil {
+			s.logger.Error("failed to set socket options", "error", err)
+		}
+
+		if s.maxAccepts > 0 {
+			switch n := s.accepted.Add(1); {
+			case n > s.maxAccepts:
+				// Another listener accepted the last connection concurrently.
+				_ = conn.Close()
+				s.releaseConn()
+				return nil
+			case n == s.maxAccepts:
+				s.dispatch(ctx, conn, conns)
+				s.logger.Log(context.Background(), s.logLevel, "maximum number of accepted connections reached", "count", n)
+
+				// Drain waits for the connections, which must not block the accept loop
+				// since the worker pool only stops once Serve returns.
+				go func() {
+					_ = s.Drain(context.Background())
+				}()
+
+				return nil
+			}
+		}
+
+		s.dispatch(ctx, conn, conns)
+	}
+}
+
+// dispatch sends the connection to conns if the worker pool is enabled, serves it on the calling goroutine
+// if Sequential is set, or serves it in its own goroutine otherwise.
+func (s *Server) dispatch(ctx context.Context, conn net.Conn, conns chan<- net.Conn) {
+	if conns != nil {
+		conns <- conn
+		return
+	}
+
+	if s.sequential {
 		s.wg.Add(1)
-		go func(c net.Conn) {
-			defer s.wg.Done()
+		defer s.wg.Done()
+		defer s.releaseConn()
+
+		s.seqMux.Lock()
+		defer s.seqMux.Unlock()
+
+		s.serve(ctx, conn)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.releaseConn()
+
+		s.serve(ctx, conn)
+	}()
+}
+
+const (
+	minRetryDelay = 5 * time.Millisecond
+	maxRetryDelay = time.Second
+)
 
-			s.serve(c)
-		}(conn)
+// retryAccept reports whether Serve should keep accepting after err.
+// The OnAcceptError callback decides if set, otherwise temporary errors and file descriptor
+// exhaustion are retried, so the accept loop backs off instead of spinning until descriptors are released.
+func (s *Server) retryAccept(err error) bool {
+	if s.onAcceptError != nil {
+		return s.onAcceptError(err)
 	}
+
+	return isTemporary(err) || isFDExhausted(err)
 }
 
-// Addr returns the net.Addr used by the server or nil if the server is not running.
-func (s *Server) Addr() net.Addr {
-	if s.isClosing.Load() {
-		return nil
+// isTemporary reports whether err is a temporary accept error that is worth retrying.
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// nextRetryDelay doubles the previous delay, starting at minRetryDelay and capped at maxRetryDelay.
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minRetryDelay
+	}
+
+	return min(delay*2, maxRetryDelay)
+}
+
+// sleep pauses for the given duration. It returns false if the server is shut down while sleeping.
+func (s *Server) sleep(ctx context.Context, d time.Duration) bool {
+	timer := s.clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
+// Ready returns a channel that is closed once the listener is bound and the server is accepting connections.
+// It is only meaningful for a single Serve lifecycle.
+// The channel is never closed if Serve fails before listening; use WaitAddr to also learn about that failure.
+func (s *Server) Ready() <-chan struct{} {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	if s.listener == nil {
+	return s.ready
+}
+
+// setSocketOptions applies the TCP options to the connection.
+// Non-TCP connections are left untouched.
+func (s *Server) setSocketOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
 		return nil
 	}
 
-	return s.listener.Addr()
-}
-
-func (s *Server) serve(conn net.Conn) {
-	defer func() {
-		if err := conn.Close(); err != nil {
-			slog.Error("failed to close connection", "error", err)
+	switch {
+	case s.tcpKeepAlive > 0:
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
 		}
-	}()
 
-	message, err := s.decoder.Decode(conn)
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			slog.Info("connection closed by client")
-		} else {
-			slog.Error("failed to decode message", "error", err)
+		if err := tcpConn.SetKeepAlivePeriod(s.tcpKeepAlive); err != nil {
+			return err
+		}
+	case s.tcpKeepAlive < 0:
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
 		}
+	}
 
-		return
+	if s.tcpNoDelay {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			return err
+		}
 	}
 
-	response, err := s.handler(s.ctx, message)
-	if err != nil {
-		slog.Error("failed to process message", "error", err)
-		return
+	return nil
+}
+
+// WaitAddr blocks until the server is listening and returns its address,
+// or returns the context's error if ctx is done first.
+// It is the way to learn the port picked by the system when listening on port 0.
+// If Serve fails before listening, WaitAddr returns the error returned by Serve,
+// and if the server is shut down first, it returns ErrServerClosing.
+func (s *Server) WaitAddr(ctx context.Context) (net.Addr, error) {
+	s.mux.Lock()
+	ready, done := s.ready, s.done
+	s.mux.Unlock()
+
+	select {
+	case <-ready:
+	case <-done:
+		s.mux.Lock()
+		err := s.serveErr
+		s.mux.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrServerClosing
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
-	if err := s.encoder.Encode(conn, response); err != nil {
-		slog.Error("failed to encode message", "error", err)
-		return
+	addr := s.Addr()
+	if addr == nil {
+		return nil, ErrServerClosing
 	}
+
+	return addr, nil
 }
 
-// Shutdown gracefully shuts down the server.
-func (s *Server) Shutdown() {
-	if s.isClosing.Swap(true) {
-		return
+// acquireConn blocks until a connection slot is available when MaxConnections is set.
+// It returns false if the server is shut down while waiting.
+func (s *Server) acquireConn(ctx context.Context) bool {
+	if s.connSem == nil {
+		return true
 	}
 
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	select {
+	case s.connSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	if s.listener == nil {
-		return
+func (s *Server) releaseConn() {
+	if s.connSem != nil {
+		<-s.connSem
 	}
+}
 
-	if err := s.listener.Close(); err != nil {
-		slog.Error("failed to close listener", "error", err)
+// Addr returns the net.Addr used by the server or nil if the server is not running.
+// When listening on several addresses, it returns the first one.
+// The address is the one the listener is bound to, so it carries the actual port when listening on port 0.
+func (s *Server) Addr() net.Addr {
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return nil
 	}
 
-	s.ctxCancel()
-	s.wg.Wait()
+	return addrs[0]
+}
+
+// Addrs returns the net.Addr of every listener used by the server or nil if the server is not running.
+func (s *Server) Addrs() []net.Addr {
+	if s.isClosing.Load() {
+		return nil
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var addrs []net.Addr
+	for _, packetConn := range s.packetConns {
+		addrs = append(addrs, packetConn.LocalAddr())
+	}
+
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+
+	return addrs
+}
+
+// Running reports whether the server is bound to its addresses and has not started shutting down.
+func (s *Server) Running() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.runningLocked()
+}
+
+// runningLocked is like Running but requires s.mux to be held.
+func (s *Server) runningLocked() bool {
+	return !s.isClosing.Load() && (len(s.listeners) > 0 || len(s.packetConns) > 0)
+}
+
+func (s *Server) serve(ctx context.Context, conn net.Conn) {
+	s.activeConnections.Add(1)
+	defer s.activeConnections.Add(-1)
+
+	id := strconv.FormatInt(s.totalConnections.Add(1), 10)
+	logger := s.logger.With("conn_id", id)
+
+	// Recover from panics in the callbacks run before the Handler, such as the ConnFilter,
+	// which are not reported to OnDisconnect since the connection was not admitted yet.
+	defer s.recoverPanic(logger, conn.RemoteAddr(), nil)
+
+	// The connection passed to the CloseFunc is replaced by the TLS connection once the handshake is done.
+	accepted := conn
+	defer func() {
+		s.closeConn(logger, accepted)
+	}()
+
+	s.trackConn(ctx, conn)
+	defer s.untrackConn(conn)
+
+	counter := &countingConn{Conn: conn, server: s}
+	conn = counter
+
+	if s.activityTimeout > 0 {
+		conn = &activityConn{Conn: conn, timeout: s.activityTimeout}
+	}
+
+	remoteAddr := conn.RemoteAddr()
+	reader := s.newReader(conn)
+
+	if s.proxyProtocol {
+		addr, err := s.readProxyHeader(conn, reader)
+		if err != nil {
+			logger.Error("failed to read PROXY protocol header", "error", err)
+			return
+		}
+
+		if addr != nil {
+			remoteAddr = addr
+		}
+	}
+
+	if s.connFilter != nil && !s.connFilter(remoteAddr) {
+		logger.Warn("connection rejected by filter", "addr", remoteAddr.String())
+		return
+	}
+
+	if !s.acquireIP(remoteAddr) {
+		logger.Warn("connection limit per IP reached", "addr", remoteAddr.String())
+		return
+	}
+	defer s.releaseIP(remoteAddr)
+
+	if !s.acquireSubnet(remoteAddr) {
+		logger.Warn("connection limit per subnet reached", "addr", remoteAddr.String())
+		return
+	}
+	defer s.releaseSubnet(remoteAddr)
+
+	// The PROXY protocol header is sent in plaintext ahead of the TLS handshake.
+	var tlsState *tls.ConnectionState
+	if s.tlsConfig != nil {
+		tlsConn, state, err := s.startTLS(ctx, conn, reader, s.tlsConfig)
+		if err != nil {
+			logger.Error("failed to perform TLS handshake", "error", err)
+			return
+		}
+
+		logger.Log(context.Background(), s.logLevel, "TLS handshake completed",
+			"tls_version", tls.VersionName(state.Version), "cipher_suite", tls.CipherSuiteName(state.CipherSuite))
+
+		accepted, conn, tlsState = tlsConn, tlsConn, state
+		reader = s.newReader(tlsConn)
+	}
+
+	codec := s.codec()
+	if s.webSocket {
+		ws, err := s.upgradeWebSocket(conn, reader)
+		if err != nil {
+			logger.Error("failed to upgrade to WebSocket", "error", err)
+			return
+		}
+
+		codec = connCodec{decoder: ws, encoder: ws}
+	}
+
+	if s.compression != CompressionNone {
+		reader = s.newReader(s.compression.newReader(reader))
+	}
+
+	var err error
+	defer func() {
+		if s.onDisconnect != nil {
+			s.onDisconnect(remoteAddr, err)
+		}
+	}()
+
+	defer s.recoverPanic(logger, remoteAddr, &err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, remoteAddrKey{}, remoteAddr)
+	ctx = context.WithValue(ctx, connIDKey{}, id)
+	ctx = context.WithValue(ctx, countingConnKey{}, counter)
+	ctx = context.WithValue(ctx, sessionKey{}, &sync.Map{})
+	if tlsState != nil {
+		ctx = context.WithValue(ctx, tlsStateKey{}, tlsState)
+	} else if !s.webSocket && s.compression == CompressionNone {
+		ctx = context.WithValue(ctx, startTLSKey{}, &atomic.Pointer[tls.Config]{})
+	}
+
+	if s.onConnect != nil {
+		s.onConnect(ctx, remoteAddr)
+	}
+
+	handler := s.handler
+	if s.selector != nil && s.streamHandler == nil {
+		handler, err = s.selectHandler(conn, reader)
+		if err != nil {
+			err = s.decodeError(logger, remoteAddr, err)
+			return
+		}
+	}
+
+	err = s.serveMessages(ctx, conn, reader, handler, codec, logger)
+}
+
+// newReader returns the buffered reader passed to the Decoder, sized by the ReadBufferSize if set.
+func (s *Server) newReader(r io.Reader) *bufio.Reader {
+	if s.readBufferSize > 0 {
+		return bufio.NewReaderSize(r, s.readBufferSize)
+	}
+
+	return bufio.NewReader(r)
+}
+
+// closeConn closes the connection once it is served, with the CloseFunc if set.
+func (s *Server) closeConn(logger *slog.Logger, conn net.Conn) {
+	closeFunc := s.closeFunc
+	if closeFunc == nil {
+		closeFunc = net.Conn.Close
+	}
+
+	if err := closeFunc(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("failed to close connection", "error", err)
+	}
+}
+
+// recoverPanic recovers from a panic while serving addr, logs it with logger and calls the PanicHandler.
+// If err is not nil, it is set to an error describing the panic.
+// It must be deferred directly.
+func (s *Server) recoverPanic(logger *slog.Logger, addr net.Addr, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	logger.Error("panic serving connection", "addr", addr.String(), "panic", v, "stack", string(debug.Stack()))
+	if s.panicHandler != nil {
+		s.panicHandler(addr, v)
+	}
+
+	if err != nil {
+		*err = fmt.Errorf("panic serving connection: %v", v)
+	}
+}
+
+// serveMessages reads messages from the connection until it is closed by the client,
+// an error occurs or the context is canceled. It returns nil if the connection ended cleanly.
+func (s *Server) serveMessages(ctx context.Context, conn net.Conn, reader *bufio.Reader, handler Handler, codec connCodec, logger *slog.Logger) error {
+	// The context is canceled with the read error when the client closes the connection while a Handler runs.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	writer := s.newConnResponseWriter(conn, codec.encoder)
+	if ws, ok := codec.decoder.(*webSocket); ok {
+		ws.writer = writer
+	}
+
+	defer func() {
+		// The writer is replaced when the connection is upgraded with StartTLS.
+		_ = writer.Close()
+	}()
+
+	addr := RemoteAddr(ctx)
+	upgrade, _ := ctx.Value(startTLSKey{}).(*atomic.Pointer[tls.Config])
+
+	// Interrupt a blocked read as soon as the context is canceled.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			if cause := context.Cause(ctx); cause != err {
+				return s.decodeError(logger, addr, cause)
+			}
+
+			return err
+		}
+
+		if config := upgradePending(upgrade); config != nil {
+			// The response to the STARTTLS command must reach the client in plaintext before the handshake.
+			if err := writer.Flush(); err != nil {
+				return s.encodeError(logger, addr, err)
+			}
+
+			if err := writer.Close(); err != nil {
+				return s.encodeError(logger, addr, err)
+			}
+
+			tlsConn, state, err := s.startTLS(ctx, conn, reader, config)
+			if err != nil {
+				logger.Error("failed to perform STARTTLS handshake", "error", err)
+				return err
+			}
+
+			logger.Log(context.Background(), s.logLevel, "STARTTLS handshake completed",
+				"tls_version", tls.VersionName(state.Version), "cipher_suite", tls.CipherSuiteName(state.CipherSuite))
+
+			ctx = context.WithValue(ctx, tlsStateKey{}, state)
+			reader = s.newReader(tlsConn)
+			writer = s.newConnResponseWriter(tlsConn, codec.encoder)
+		}
+
+		if s.idleTimeout > 0 && reader.Buffered() == 0 {
+			if err := s.waitIdle(ctx, conn, reader, logger, addr); err != nil {
+				return err
+			}
+		}
+
+		// deadline is the read deadline of the message, which also bounds its Handler.
+		var deadline time.Time
+		if s.readTimeout > 0 || s.idleTimeout > 0 {
+			// A zero deadline clears the idle deadline when there is no read timeout.
+			if s.readTimeout > 0 {
+				deadline = time.Now().Add(s.readTimeout)
+			}
+
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				logger.Error("failed to set read deadline", "error", err)
+				return err
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		frameCtx, message, err := s.decode(ctx, codec, reader)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			return s.decodeError(logger, addr, err)
+		}
+
+		s.totalMessages.Add(1)
+
+		if s.skipEmpty && codec.isEmpty(message) {
+			continue
+		}
+
+		msgCtx, msgLogger, message := s.correlate(frameCtx, logger, message)
+
+		stopWatching := s.watchDisconnect(conn, reader, codec, cancel)
+		response, err := s.handle(msgCtx, msgLogger, handler, message, deadline, writer)
+		if err := stopWatching(); err != nil {
+			return s.decodeError(msgLogger, addr, err)
+		}
+
+		if err := writer.Flush(); err != nil {
+			return s.encodeError(msgLogger, addr, err)
+		}
+
+		if errors.Is(err, ErrHandlerTimeout) {
+			if err := writer.Write(s.timeoutResponse); err != nil {
+				return s.encodeError(msgLogger, addr, err)
+			}
+
+			if err := writer.Flush(); err != nil {
+				return s.encodeError(msgLogger, addr, err)
+			}
+
+			return err
+		}
+
+		closeConn := errors.Is(err, ErrCloseConnection)
+		if err != nil && !closeConn {
+			s.reportError(msgLogger, addr, "handle", err, "failed to process message")
+			if s.errorEncoder == nil {
+				return err
+			}
+
+			if payload := s.errorEncoder(msgCtx, err); payload != nil {
+				if err := writer.Write(payload); err != nil {
+					return s.encodeError(msgLogger, addr, err)
+				}
+			}
+
+			if s.disableKeepAlive {
+				return nil
+			}
+
+			continue
+		}
+
+		if s.streamHandler == nil {
+			response, err = s.intercept(msgCtx, message, response)
+			if err != nil {
+				msgLogger.Error("failed to intercept response", "error", err)
+				return err
+			}
+
+			if response != nil {
+				if err := writer.Write(response); err != nil {
+					return s.encodeError(msgLogger, addr, err)
+				}
+			}
+		}
+
+		if closeConn || s.disableKeepAlive {
+			return nil
+		}
+	}
+}
+
+// waitIdle waits for the first byte of the next message for up to the IdleTimeout and returns ErrIdleTimeout
+// if none arrives. The timeout is measured with the server clock, which interrupts the read once it elapses.
+func (s *Server) waitIdle(ctx context.Context, conn net.Conn, reader *bufio.Reader, logger *slog.Logger, addr net.Addr) error {
+	// Clear the read deadline of the previous message, so only the IdleTimeout bounds the wait.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		logger.Error("failed to set read deadline", "error", err)
+		return err
+	}
+
+	// The deadline set on cancellation may have just been overwritten.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var idle atomic.Bool
+	fired := make(chan struct{})
+	timer := s.clock.AfterFunc(s.idleTimeout, func() {
+		defer close(fired)
+
+		idle.Store(true)
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+	})
+
+	_, err := reader.Peek(1)
+	if !timer.Stop() {
+		// Wait for the deadline to be set, so the message loop can safely set its own.
+		<-fired
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if idle.Load() && errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.Log(context.Background(), s.logLevel, "idle timeout", "timeout", s.idleTimeout)
+		return ErrIdleTimeout
+	}
+
+	return s.decodeError(logger, addr, err)
+}
+
+// watchDisconnect waits in the background for the next bytes of the connection while a Handler runs,
+// and cancels the connection context with the read error if the client closes the connection first.
+// The returned function stops watching and must be called before reading from reader again.
+//
+// Nothing is watched when the next message is already buffered, when the stream is compressed,
+// since an interrupted read would corrupt the decompressor, or when the Decoder reads until the end
+// of the stream, since the client then half-closes the connection and waits for the response.
+func (s *Server) watchDisconnect(conn net.Conn, reader *bufio.Reader, codec connCodec, cancel context.CancelCauseFunc) func() error {
+	_, readAll := codec.decoder.(*ReadAllDecoder)
+	if reader.Buffered() > 0 || s.compression != CompressionNone || (readAll && codec.frameDecoder == nil) {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel(err)
+		}
+	}()
+
+	return func() error {
+		// Interrupt the pending read, then clear the deadline, which the message loop sets again if needed.
+		// Setting the deadline only fails once the connection is closed, which also ends the read.
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		return conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, which makes pending reads return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// correlate extracts the correlation ID of the message when a CorrelationExtractor is set.
+// It returns the context and logger carrying the ID and the message without it.
+func (s *Server) correlate(ctx context.Context, logger *slog.Logger, message []byte) (context.Context, *slog.Logger, []byte) {
+	if s.correlationFunc == nil {
+		return ctx, logger, message
+	}
+
+	id, rest := s.correlationFunc(message)
+	ctx = context.WithValue(ctx, correlationIDKey{}, id)
+	logger = logger.With("correlation_id", string(id))
+
+	return ctx, logger, rest
+}
+
+// intercept passes the response through the ResponseInterceptor if set.
+// Nil responses are returned as is.
+func (s *Server) intercept(ctx context.Context, message, response []byte) ([]byte, error) {
+	if s.interceptor == nil || response == nil {
+		return response, nil
+	}
+
+	return s.interceptor(ctx, message, response)
+}
+
+// handle invokes the StreamHandler if set, or handler otherwise, bounding its execution with the soonest
+// of the HandlerTimeout and the read deadline of the message, if set, and reports the outcome to OnMessage.
+// The Handler context carries that deadline, so downstream calls can honor it.
+// The response is always nil when the StreamHandler is invoked, since it writes to w directly.
+func (s *Server) handle(ctx context.Context, logger *slog.Logger, handler Handler, message []byte, deadline time.Time, w ResponseWriter) ([]byte, error) {
+	start := s.clock.Now()
+
+	if s.handlerTimeout > 0 {
+		// Deadlines are enforced by the runtime, so they are based on the wall clock.
+		if d := time.Now().Add(s.handlerTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	handlerCtx := ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var response []byte
+	var err error
+	switch {
+	case s.streamHandler != nil:
+		err = s.streamHandler(handlerCtx, message, w)
+	case !deadline.IsZero() && s.timeoutResponse != nil:
+		response, err = s.callWithTimeout(handlerCtx, logger, handler, message)
+	default:
+		response, err = handler(handlerCtx, message)
+	}
+
+	if !deadline.IsZero() && errors.Is(handlerCtx.Err(), context.DeadlineExceeded) {
+		logger.Warn("handler exceeded its deadline", "deadline", deadline)
+	}
+
+	if s.onMessage != nil {
+		s.onMessage(RemoteAddr(ctx), len(message), s.clock.Now().Sub(start), err)
+	}
+
+	if s.recent != nil {
+		s.recent.add(RemoteAddr(ctx), start, message, response, err)
+	}
+
+	return response, err
+}
+
+// callWithTimeout invokes handler in its own goroutine and returns ErrHandlerTimeout as soon as ctx exceeds its deadline,
+// so the TimeoutResponse can be written right away. The response the handler eventually returns is discarded.
+func (s *Server) callWithTimeout(ctx context.Context, logger *slog.Logger, handler Handler, message []byte) ([]byte, error) {
+	type result struct {
+		response []byte
+		err      error
+	}
+
+	done := make(chan result, 1)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		var res result
+		defer func() { done <- res }()
+		defer s.recoverPanic(logger, RemoteAddr(ctx), &res.err)
+
+		res.response, res.err = handler(ctx, message)
+	}()
+
+	select {
+	case res := <-done:
+		return res.response, res.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrHandlerTimeout
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// decodeError logs an error returned while reading a message and returns the error that terminates the connection.
+// It returns nil if the connection was closed by the client.
+func (s *Server) decodeError(logger *slog.Logger, addr net.Addr, err error) error {
+	switch {
+	case errors.Is(err, io.EOF):
+		logger.Log(context.Background(), s.logLevel, "connection closed by client")
+		return nil
+	case isConnClosed(err):
+		logger.Debug("connection closed", "error", err)
+	case errors.Is(err, ErrActivityTimeout):
+		logger.Log(context.Background(), s.logLevel, "activity timeout", "timeout", s.activityTimeout)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Log(context.Background(), s.logLevel, "read timeout", "timeout", s.readTimeout)
+	default:
+		s.reportError(logger, addr, "decode", err, "failed to decode message")
+	}
+
+	return err
+}
+
+// encodeError logs an error returned while writing a response and returns it.
+func (s *Server) encodeError(logger *slog.Logger, addr net.Addr, err error) error {
+	switch {
+	case isConnClosed(err):
+		logger.Debug("connection closed", "error", err)
+	case errors.Is(err, ErrActivityTimeout):
+		logger.Log(context.Background(), s.logLevel, "activity timeout", "timeout", s.activityTimeout)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Log(context.Background(), s.logLevel, "write timeout", "timeout", s.writeTimeout)
+	default:
+		s.reportError(logger, addr, "encode", err, "failed to encode message")
+	}
+
+	return err
+}
+
+// reportError passes an error of the given stage to OnError if set, or logs it with msg and args otherwise.
+func (s *Server) reportError(logger *slog.Logger, addr net.Addr, stage string, err error, msg string, args ...any) {
+	if s.onError != nil {
+		s.onError(addr, stage, err)
+		return
+	}
+
+	logger.Error(msg, append(args, "error", err)...)
+}
+
+// isConnClosed reports whether err means the connection is gone, either because the client
+// disconnected abruptly, breaking the pipe or resetting the connection, or because it was closed on Shutdown.
+func isConnClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || isBrokenConn(err)
+}
+
+// Shutdown gracefully shuts down the server.
+// It waits indefinitely for in-flight connections to finish.
+func (s *Server) Shutdown() {
+	_ = s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext gracefully shuts down the server.
+// It closes the listener immediately, so no new connections are accepted,
+// cancels the Handler context, closes the active connections so blocked reads and writes return,
+// and waits for in-flight connections to finish.
+// If ctx is done before all connections finish, it returns the context's error.
+// It is safe to call concurrently: every call waits for the shutdown to complete.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	return s.stop(ctx, true)
+}
+
+// Drain stops accepting new connections and waits for in-flight connections to finish.
+// Unlike ShutdownContext, the Handler context is not canceled and the connections are not closed
+// unless ctx is done before all connections finish, in which case it returns the context's error.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.stop(ctx, false)
+}
+
+// Close immediately closes the listener and the active connections and cancels the Handler context,
+// without waiting for in-flight handlers to return.
+// It is safe to call concurrently with Shutdown, which keeps waiting for the handlers to return.
+func (s *Server) Close() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = s.stop(ctx, true)
+}
+
+// stop closes the listener and waits for in-flight connections to finish or ctx to be done.
+// The Handler context is canceled immediately if cancel is true, or once ctx is done otherwise.
+// Only the first call closes the listener; later calls wait for the same shutdown to complete.
+func (s *Server) stop(ctx context.Context, cancel bool) error {
+	s.mux.Lock()
+	ctxCancel, stopped := s.ctxCancel, s.stopped
+	if cancel {
+		ctxCancel()
+		s.closeConnsLocked()
+	}
+
+	if s.isClosing.Swap(true) {
+		s.mux.Unlock()
+		return s.waitStopped(ctx, stopped, ctxCancel)
+	}
+
+	s.closeDoneLocked()
+
+	if len(s.listeners) == 0 && len(s.packetConns) == 0 {
+		close(stopped)
+		s.mux.Unlock()
+		return nil
+	}
+
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			s.logger.Error("failed to close listener", "error", err)
+		}
+	}
+
+	for _, packetConn := range s.packetConns {
+		if err := packetConn.Close(); err != nil {
+			s.logger.Error("failed to close packet connection", "error", err)
+		}
+	}
+
+	s.mux.Unlock()
+
+	go func() {
+		s.wg.Wait()
+		if s.onShutdown != nil {
+			s.onShutdown()
+		}
+
+		close(stopped)
+	}()
+
+	return s.waitStopped(ctx, stopped, ctxCancel)
+}
+
+// failLocked records err as the reason Serve stopped before listening and unblocks WaitAddr.
+// s.mux must be held.
+func (s *Server) failLocked(err error) {
+	s.serveErr = err
+	s.closeDoneLocked()
+}
+
+// closeDoneLocked closes the done channel unless it is already closed.
+// s.mux must be held.
+func (s *Server) closeDoneLocked() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// waitStopped waits for stopped to be closed. If ctx is done first, it cancels the Handler context,
+// closes the active connections and returns the context's error.
+func (s *Server) waitStopped(ctx context.Context, stopped <-chan struct{}, ctxCancel context.CancelFunc) error {
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		ctxCancel()
+
+		s.mux.Lock()
+		s.closeConnsLocked()
+		s.mux.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// trackConn registers an active connection so it can be closed on Shutdown.
+// If the server is already shutting down, the connection is closed right away.
+func (s *Server) trackConn(ctx context.Context, conn net.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if ctx.Err() != nil {
+		_ = conn.Close()
+		return
+	}
+
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// closeConnsLocked closes every active connection, which unblocks pending reads and writes.
+// s.mux must be held.
+func (s *Server) closeConnsLocked() {
+	for conn := range s.conns {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("failed to close connection", "error", err)
+		}
+	}
+}
+
+// Reset prepares a shut down server to Serve again.
+// It must be called after Shutdown returns; it returns an error if the server is still running.
+func (s *Server) Reset() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.runningLocked() {
+		return ErrServerRunning
+	}
+
+	s.ctxCancel()
+	s.ctx, s.ctxCancel = context.WithCancel(s.parent)
+	s.listeners = nil
+	s.packetConns = nil
+	s.ready = make(chan struct{})
+	s.done = make(chan struct{})
+	s.serveErr = nil
+	s.stopped = make(chan struct{})
+	s.accepted.Store(0)
+	s.isClosing.Store(false)
+
+	return nil
 }
@@ -0,0 +1,1882 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestHandlerContextCanceledOnDisconnect(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+
+			select {
+			case <-ctx.Done():
+				canceled <- ctx.Err()
+			case <-time.After(testTimeout):
+				canceled <- nil
+			}
+
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.send("hello\n")
+	<-started
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	if err := <-canceled; err == nil {
+		t.Fatal("the Handler context was not canceled when the client closed the connection")
+	}
+}
+
+func TestHandlerContextNotCanceledWhileConnected(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			time.Sleep(20 * time.Millisecond)
+			if err := ctx.Err(); err != nil {
+				return []byte(err.Error() + "\n"), nil
+			}
+
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	for _, message := range []string{"one", "two", "three"} {
+		if got := conn.roundTrip(message); got != message {
+			t.Errorf("got %q, want %q", got, message)
+		}
+	}
+
+	// Messages sent while the Handler runs are served in order.
+	conn.send("four\n")
+	conn.send("five\n")
+	for _, want := range []string{"four", "five"} {
+		if got := conn.readLine(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSkipEmptyMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   *tcpserver.DelimiterCodec
+		message string
+		empty   string
+	}{
+		{name: "default new line decoder", message: "hello\n", empty: "\n"},
+		{name: "delimiter kept", codec: &tcpserver.DelimiterCodec{Delimiter: "\r\n", KeepDelimiter: true}, message: "hello\r\n", empty: "\r\n"},
+		{name: "delimiter stripped", codec: &tcpserver.DelimiterCodec{Delimiter: "\r\n"}, message: "hello\r\n", empty: "\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			cfg := tcpserver.Config{
+				SkipEmptyMessages: true,
+				Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+					calls.Add(1)
+					return []byte("handled\n"), nil
+				},
+			}
+
+			if tt.codec != nil {
+				cfg.Decoder = tt.codec
+			}
+
+			_, addr := startServer(t, cfg)
+
+			conn := dial(t, addr)
+			conn.send(tt.empty + tt.empty + tt.message + tt.empty)
+			if got := conn.readLine(); got != "handled" {
+				t.Errorf("got %q, want %q", got, "handled")
+			}
+
+			conn.send(tt.message)
+			if got := conn.readLine(); got != "handled" {
+				t.Errorf("got %q, want %q", got, "handled")
+			}
+
+			if got := calls.Load(); got != 2 {
+				t.Errorf("the Handler was called %d times, want 2", got)
+			}
+		})
+	}
+}
+
+func TestEmptyMessagesAreHandledByDefault(t *testing.T) {
+	var calls atomic.Int64
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			calls.Add(1)
+			return []byte("handled\n"), nil
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip(""); got != "handled" {
+		t.Errorf("got %q, want %q", got, "handled")
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("the Handler was called %d times, want 1", got)
+	}
+}
+
+func TestConnFilterPanicDoesNotCrashServer(t *testing.T) {
+	var calls atomic.Int64
+	panics := make(chan any, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		ConnFilter: func(remote net.Addr) bool {
+			if calls.Add(1) == 1 {
+				panic("filter failed")
+			}
+
+			return true
+		},
+		PanicHandler: func(addr net.Addr, v any) {
+			panics <- v
+		},
+	})
+
+	dial(t, addr).expectClosed()
+
+	select {
+	case v := <-panics:
+		if v != "filter failed" {
+			t.Errorf("got panic %v, want %q", v, "filter failed")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the PanicHandler was not called")
+	}
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestPanicIsLoggedWithConnID(t *testing.T) {
+	configs := map[string]tcpserver.Config{
+		"handler":              {},
+		"handler with timeout": {HandlerTimeout: time.Minute},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			recorder, logger := newLogRecorder()
+			ids := make(chan string, 1)
+
+			cfg.Logger = logger
+			cfg.Handler = func(ctx context.Context, message []byte) ([]byte, error) {
+				ids <- tcpserver.ConnID(ctx)
+				panic("handler failed")
+			}
+
+			_, addr := startServer(t, cfg)
+
+			conn := dial(t, addr)
+			conn.send("hello\n")
+			conn.expectClosed()
+
+			id := <-ids
+			records := recorder.waitRecords(t, "panic serving connection", 1)
+			if got := records[0]["conn_id"]; got != id {
+				t.Errorf("got conn_id %v, want %q", got, id)
+			}
+		})
+	}
+}
+
+func TestMessagesInASingleWrite(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{})
+
+	conn := dial(t, addr)
+	conn.send("first\nsecond\n")
+	for _, want := range []string{"first", "second"} {
+		if got := conn.readLine(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	var calls atomic.Int64
+	_, addr := startServer(t, tcpserver.Config{
+		DisableKeepAlive: true,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			calls.Add(1)
+			return message, nil
+		},
+	})
+
+	// The second message is already sent when the first one is handled, but it is never answered.
+	conn := dial(t, addr)
+	conn.send("first\nsecond\n")
+	if got := conn.readLine(); got != "first" {
+		t.Errorf("got %q, want %q", got, "first")
+	}
+
+	conn.expectClosed()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("the Handler was called %d times, want 1", got)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		ReadTimeout: 100 * time.Millisecond,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	// The client stalls in the middle of a message.
+	conn := dial(t, addr)
+	conn.send("hel")
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got disconnect error %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		WriteTimeout: 100 * time.Millisecond,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return bytes.Repeat([]byte("x"), 64<<20), nil
+		},
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	// The client never reads the response, so the server cannot write it in full.
+	conn := dial(t, addr)
+	conn.send("hello\n")
+
+	select {
+	case err := <-disconnected:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got disconnect error %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the connection was not closed once the write timeout elapsed")
+	}
+}
+
+func TestShutdownContextDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+			<-release
+			return message, nil
+		},
+	})
+	defer close(release)
+
+	dial(t, addr).send("hello\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := server.ShutdownContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ShutdownContext returned after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	const maxConnections = 2
+	_, addr := startServer(t, tcpserver.Config{MaxConnections: maxConnections})
+
+	var conns []*testConn
+	for range maxConnections {
+		conn := dial(t, addr)
+		if got := conn.roundTrip("hello"); got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+
+		conns = append(conns, conn)
+	}
+
+	// The extra connection is queued by the system but not served.
+	extra := dial(t, addr)
+	extra.send("waiting\n")
+
+	if err := extra.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	if _, err := extra.reader.ReadByte(); !isTimeout(err) {
+		t.Fatalf("got error %v while the limit is reached, want a timeout", err)
+	}
+
+	if err := extra.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	if got := extra.readLine(); got != "waiting" {
+		t.Errorf("got %q once a connection was closed, want %q", got, "waiting")
+	}
+}
+
+func TestHandlerPanicDoesNotCrashServer(t *testing.T) {
+	var panics atomic.Int64
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "panic\n" {
+				panic("handler failed")
+			}
+
+			return message, nil
+		},
+		PanicHandler: func(addr net.Addr, v any) {
+			panics.Add(1)
+		},
+	})
+
+	for range 3 {
+		conn := dial(t, addr)
+		conn.send("panic\n")
+		conn.expectClosed()
+	}
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	if got := panics.Load(); got != 3 {
+		t.Errorf("the PanicHandler was called %d times, want 3", got)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	recorder, logger := newLogRecorder()
+	_, addr := startServer(t, tcpserver.Config{Logger: logger})
+
+	conn := dial(t, addr)
+	conn.roundTrip("hello")
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	records := recorder.waitRecords(t, "connection closed by client", 1)
+	if _, ok := records[0]["conn_id"]; !ok {
+		t.Errorf("got record %v, want a conn_id attribute", records[0])
+	}
+}
+
+func TestNoopListenerAddrFunc(t *testing.T) {
+	tests := []struct {
+		name             string
+		listenerAddrFunc func(net.Addr)
+		want             int
+	}{
+		{name: "default", want: 1},
+		{name: "noop", listenerAddrFunc: tcpserver.NoopListenerAddrFunc, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, logger := newLogRecorder()
+			server := tcpserver.New(tcpserver.Config{
+				Logger:              logger,
+				ListenerAddrFunc:    tt.listenerAddrFunc,
+				AllowDefaultHandler: true,
+			})
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Serve()
+			}()
+
+			<-server.Ready()
+			server.Shutdown()
+			if err := <-errCh; err != nil {
+				t.Fatalf("server stopped with error: %v", err)
+			}
+
+			if got := len(recorder.records(t, "server listening")); got != tt.want {
+				t.Errorf("got %d records logged with %q, want %d", got, "server listening", tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionLifecycleHooks(t *testing.T) {
+	errHandler := errors.New("handler failed")
+
+	tests := []struct {
+		name    string
+		message string
+		want    error
+	}{
+		{name: "closed by client", message: "hello\n"},
+		{name: "handler error", message: "fail\n", want: errHandler},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var connects, disconnects atomic.Int64
+			disconnected := make(chan error, 2)
+			_, addr := startServer(t, tcpserver.Config{
+				Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+					if string(message) == "fail\n" {
+						return nil, errHandler
+					}
+
+					return message, nil
+				},
+				OnConnect: func(ctx context.Context, addr net.Addr) {
+					connects.Add(1)
+				},
+				OnDisconnect: func(addr net.Addr, err error) {
+					disconnects.Add(1)
+					disconnected <- err
+				},
+			})
+
+			conn := dial(t, addr)
+			conn.send(tt.message)
+			if tt.want == nil {
+				conn.readLine()
+				if err := conn.Close(); err != nil {
+					t.Fatalf("failed to close connection: %v", err)
+				}
+			} else {
+				conn.expectClosed()
+			}
+
+			if err := <-disconnected; !errors.Is(err, tt.want) {
+				t.Errorf("got disconnect error %v, want %v", err, tt.want)
+			}
+
+			// Another connection proves the hooks of the first one are not called again.
+			dial(t, addr).roundTrip("hello")
+
+			if got := connects.Load(); got != 2 {
+				t.Errorf("OnConnect was called %d times, want 2", got)
+			}
+
+			if got := disconnects.Load(); got != 1 {
+				t.Errorf("OnDisconnect was called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAcceptRetriesTemporaryErrors(t *testing.T) {
+	listener := newFailingListener(t, temporaryError{}, temporaryError{})
+	_, addr := startServer(t, tcpserver.Config{Listener: listener})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestServeReturnsAcceptError(t *testing.T) {
+	errAccept := errors.New("accept failed")
+	server := tcpserver.New(tcpserver.Config{
+		Listener:            newFailingListener(t, errAccept),
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errAccept) {
+			t.Errorf("got error %v, want %v", err, errAccept)
+		}
+	case <-time.After(testTimeout):
+		server.Shutdown()
+		t.Fatal("Serve did not return the accept error")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	server, addr := startServer(t, tcpserver.Config{Network: "unix", Address: path})
+
+	conn := dialNetwork(t, "unix", addr)
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	server.Shutdown()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v for the socket file after Shutdown, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		unlink  bool
+		removed bool
+	}{
+		{name: "unlink on close", unlink: true, removed: true},
+		{name: "keep on close", unlink: false, removed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "server.sock")
+			listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+
+			// A listener created by net.Listen removes its socket file on close, unlike one adopted with net.FileListener.
+			listener.SetUnlinkOnClose(tt.unlink)
+
+			server, addr := startServer(t, tcpserver.Config{Listener: listener})
+			conn := dialNetwork(t, "unix", addr)
+			if got := conn.roundTrip("hello"); got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close connection: %v", err)
+			}
+
+			server.Shutdown()
+			_, err = os.Stat(path)
+			if tt.removed && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got error %v for the socket file after Shutdown, want %v", err, fs.ErrNotExist)
+			}
+
+			if !tt.removed && err != nil {
+				t.Errorf("the socket file was removed on Shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	select {
+	case <-server.Ready():
+		t.Fatal("the server is ready before Serve was called")
+	default:
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	defer func() {
+		server.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	}()
+
+	select {
+	case <-server.Ready():
+	case <-time.After(testTimeout):
+		t.Fatal("the server did not become ready")
+	}
+
+	if got := dial(t, server.Addr().String()).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestServeAfterReset(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	for i := range 2 {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- server.Serve()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		addr, err := server.WaitAddr(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to start server %d: %v", i, err)
+		}
+
+		if err := server.Reset(); !errors.Is(err, tcpserver.ErrServerRunning) {
+			t.Errorf("got error %v resetting a running server, want %v", err, tcpserver.ErrServerRunning)
+		}
+
+		if got := dial(t, addr.String()).roundTrip("hello"); got != "hello" {
+			t.Errorf("got %q, want %q", got, "hello")
+		}
+
+		server.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Fatalf("server stopped with error: %v", err)
+		}
+
+		if err := server.Reset(); err != nil {
+			t.Fatalf("failed to reset the server: %v", err)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		IdleTimeout: 100 * time.Millisecond,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, tcpserver.ErrIdleTimeout) {
+		t.Errorf("got disconnect error %v, want %v", err, tcpserver.ErrIdleTimeout)
+	}
+}
+
+func TestHandlerTimeoutCancelsContext(t *testing.T) {
+	done := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		HandlerTimeout: 50 * time.Millisecond,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				done <- ctx.Err()
+			case <-time.After(testTimeout):
+				done <- nil
+			}
+
+			return message, nil
+		},
+	})
+
+	dial(t, addr).send("hello\n")
+
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got context error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestErrCloseConnection(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return []byte("bye\n"), tcpserver.ErrCloseConnection
+		},
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("quit"); got != "bye" {
+		t.Errorf("got %q, want %q", got, "bye")
+	}
+
+	conn.expectClosed()
+
+	if err := <-disconnected; err != nil {
+		t.Errorf("got disconnect error %v, want nil", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+			<-release
+
+			if err := ctx.Err(); err != nil {
+				return []byte(err.Error() + "\n"), nil
+			}
+
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.send("in flight\n")
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		drained <- server.Drain(ctx)
+	}()
+
+	// New connections are refused once the listener is closed.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		extra, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		_ = extra.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatal("new connections are still accepted while draining")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+
+	if got := conn.readLine(); got != "in flight" {
+		t.Errorf("got %q from the in-flight connection, want %q", got, "in flight")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("failed to close connection: %v", err)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("failed to drain: %v", err)
+	}
+}
+
+// concurrencyHandler returns a Handler that records in peak the maximum number of concurrent invocations.
+func concurrencyHandler(peak *atomic.Int64) tcpserver.Handler {
+	var running atomic.Int64
+	return func(ctx context.Context, message []byte) ([]byte, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			current := peak.Load()
+			if n <= current || peak.CompareAndSwap(current, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		return message, nil
+	}
+}
+
+// sendConcurrently sends a message on n connections at the same time and closes each one once answered.
+func sendConcurrently(t *testing.T, network, addr string, n int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.DialTimeout(network, addr, testTimeout)
+			if err != nil {
+				t.Errorf("failed to dial: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			_ = conn.SetDeadline(time.Now().Add(testTimeout))
+			if _, err := conn.Write([]byte("hello\n")); err != nil {
+				t.Errorf("failed to write: %v", err)
+				return
+			}
+
+			if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+				t.Errorf("failed to read the response: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMaxWorkers(t *testing.T) {
+	const maxWorkers = 2
+
+	var peak atomic.Int64
+	_, addr := startServer(t, tcpserver.Config{MaxWorkers: maxWorkers, Handler: concurrencyHandler(&peak)})
+
+	sendConcurrently(t, "tcp", addr, 6)
+
+	if got := peak.Load(); got > maxWorkers {
+		t.Errorf("got %d handlers running concurrently, want at most %d", got, maxWorkers)
+	}
+}
+
+func TestSequential(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			var peak atomic.Int64
+			_, addr := startServer(t, tcpserver.Config{
+				Network:    network,
+				Address:    "127.0.0.1:0",
+				Sequential: true,
+				Handler:    concurrencyHandler(&peak),
+			})
+
+			sendConcurrently(t, network, addr, 4)
+
+			if got := peak.Load(); got != 1 {
+				t.Errorf("got %d handlers running concurrently, want 1", got)
+			}
+		})
+	}
+}
+
+func TestServeTwice(t *testing.T) {
+	server, _ := startServer(t, tcpserver.Config{})
+
+	if err := server.Serve(); !errors.Is(err, tcpserver.ErrServerRunning) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrServerRunning)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		MaxMessageSize: 1024,
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	conn := dial(t, addr)
+	if got := conn.roundTrip("small enough"); got != "small enough" {
+		t.Errorf("got %q, want %q", got, "small enough")
+	}
+
+	conn.send(strings.Repeat("x", 4096))
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, tcpserver.ErrMessageTooLarge) {
+		t.Errorf("got disconnect error %v, want %v", err, tcpserver.ErrMessageTooLarge)
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	type event struct {
+		size int
+		dur  time.Duration
+		err  error
+	}
+
+	events := make(chan event, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			time.Sleep(time.Millisecond)
+			return message, nil
+		},
+		OnMessage: func(addr net.Addr, size int, dur time.Duration, err error) {
+			events <- event{size: size, dur: dur, err: err}
+		},
+	})
+
+	dial(t, addr).roundTrip("hello")
+
+	e := <-events
+	if e.size != len("hello\n") {
+		t.Errorf("got size %d, want %d", e.size, len("hello\n"))
+	}
+
+	if e.dur <= 0 {
+		t.Errorf("got duration %v, want a positive duration", e.dur)
+	}
+
+	if e.err != nil {
+		t.Errorf("got error %v, want nil", e.err)
+	}
+}
+
+// pipeListener is an in-memory listener whose connections are created with net.Pipe.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial returns the client end of a new connection accepted by the listener.
+func (l *pipeListener) dial(t *testing.T) *testConn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-time.After(testTimeout):
+		t.Fatal("the connection was not accepted")
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+	return newTestConn(t, client)
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestCustomListener(t *testing.T) {
+	listener := newPipeListener()
+	_, addr := startServer(t, tcpserver.Config{Listener: listener})
+
+	if addr != "pipe" {
+		t.Errorf("got address %q, want %q", addr, "pipe")
+	}
+
+	conn := listener.dial(t)
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	server, _ := startServer(t, tcpserver.Config{Addresses: []string{"127.0.0.1:0", "127.0.0.1:0"}})
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("got %d addresses, want 2", len(addrs))
+	}
+
+	if addrs[0].String() == addrs[1].String() {
+		t.Fatalf("got the same address %v twice", addrs[0])
+	}
+
+	for _, addr := range addrs {
+		if got := dial(t, addr.String()).roundTrip("hello"); got != "hello" {
+			t.Errorf("got %q on %v, want %q", got, addr, "hello")
+		}
+	}
+}
+
+func TestWaitAddr(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err := server.WaitAddr(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v before Serve, want %v", err, context.DeadlineExceeded)
+	}
+	cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	defer func() {
+		server.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	addr, err := server.WaitAddr(ctx)
+	if err != nil {
+		t.Fatalf("failed to wait for the address: %v", err)
+	}
+
+	if got := dial(t, addr.String()).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestWaitAddrServeFailure(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{Address: "127.0.0.1:0"})
+	errRegister := errors.New("failed to register")
+
+	tests := []struct {
+		name   string
+		config tcpserver.Config
+		want   error
+	}{
+		{name: "address in use", config: tcpserver.Config{Address: addr}, want: tcpserver.ErrAddressInUse},
+		{name: "OnListen error", config: tcpserver.Config{OnListen: func(addr net.Addr) error { return errRegister }}, want: errRegister},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.config
+			cfg.Logger = discardLogger()
+			cfg.ListenerAddrFunc = tcpserver.NoopListenerAddrFunc
+			cfg.AllowDefaultHandler = true
+			server := tcpserver.New(cfg)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Serve()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			if _, err := server.WaitAddr(ctx); !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+
+			if err := <-errCh; !errors.Is(err, tt.want) {
+				t.Errorf("Serve returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitAddrShutdownBeforeServe(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	server.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := server.WaitAddr(ctx); !errors.Is(err, tcpserver.ErrServerClosing) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrServerClosing)
+	}
+}
+
+func TestNilResponseWritesNothing(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "silent\n" {
+				return nil, nil
+			}
+
+			return message, nil
+		},
+	})
+
+	// The response to the second message is the first thing read, so nothing was written for the first one.
+	conn := dial(t, addr)
+	conn.send("silent\n")
+	if got := conn.roundTrip("loud"); got != "loud" {
+		t.Errorf("got %q, want %q", got, "loud")
+	}
+}
+
+func TestShutdownClosesActiveConnections(t *testing.T) {
+	started := make(chan struct{})
+	server, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	// One connection is blocked reading its next message and the other one in the Handler.
+	idle := dial(t, addr)
+	busy := dial(t, addr)
+	busy.send("hello\n")
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown did not return")
+	}
+
+	idle.expectClosed()
+	busy.expectClosed()
+}
+
+func TestOnAcceptErrorIgnoresError(t *testing.T) {
+	errAccept := errors.New("accept failed")
+	seen := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		Listener: newFailingListener(t, errAccept),
+		OnAcceptError: func(err error) bool {
+			seen <- err
+			return true
+		},
+	})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	if err := <-seen; !errors.Is(err, errAccept) {
+		t.Errorf("got accept error %v, want %v", err, errAccept)
+	}
+}
+
+func TestOnAcceptErrorStopsServing(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Listener:            newFailingListener(t, temporaryError{}),
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+		OnAcceptError: func(err error) bool {
+			return false
+		},
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.As(err, new(temporaryError)) {
+			t.Errorf("got error %v, want the temporary accept error", err)
+		}
+	case <-time.After(testTimeout):
+		server.Shutdown()
+		t.Fatal("Serve did not return the accept error")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn} {
+		t.Run(level.String(), func(t *testing.T) {
+			recorder, logger := newLogRecorder()
+			_, addr := startServer(t, tcpserver.Config{Logger: logger, LogLevel: level})
+
+			conn := dial(t, addr)
+			conn.roundTrip("hello")
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close connection: %v", err)
+			}
+
+			records := recorder.waitRecords(t, "connection closed by client", 1)
+			if got := records[0][slog.LevelKey]; got != level.String() {
+				t.Errorf("got level %v, want %v", got, level)
+			}
+		})
+	}
+}
+
+func TestRunning(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	if server.Running() {
+		t.Error("the server is running before Serve was called")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	<-server.Ready()
+	if !server.Running() {
+		t.Error("the server is not running once ready")
+	}
+
+	server.Shutdown()
+	if server.Running() {
+		t.Error("the server is still running once Shutdown returned")
+	}
+
+	if err := <-errCh; err != nil {
+		t.Errorf("server stopped with error: %v", err)
+	}
+}
+
+func TestResponseInterceptor(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return bytes.TrimSpace(message), nil
+		},
+		ResponseInterceptor: func(ctx context.Context, req, resp []byte) ([]byte, error) {
+			return fmt.Appendf(resp, " %08x\n", crc32.ChecksumIEEE(resp)), nil
+		},
+	})
+
+	got := dial(t, addr).roundTrip("hello")
+
+	body, checksum, ok := strings.Cut(got, " ")
+	if !ok || body != "hello" {
+		t.Fatalf("got %q, want the message followed by its checksum", got)
+	}
+
+	if want := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))); checksum != want {
+		t.Errorf("got checksum %q, want %q", checksum, want)
+	}
+}
+
+func TestAddrReportsResolvedPort(t *testing.T) {
+	server, _ := startServer(t, tcpserver.Config{Address: "127.0.0.1:0"})
+
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("got address %v of type %T, want a *net.TCPAddr", server.Addr(), server.Addr())
+	}
+
+	if addr.Port == 0 {
+		t.Errorf("got port 0, want the port chosen by the system")
+	}
+
+	if got := dial(t, addr.String()).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestDefaultHandler(t *testing.T) {
+	recorder, logger := newLogRecorder()
+	_, addr := startServer(t, tcpserver.Config{Logger: logger})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	records := recorder.records(t, "no handler configured, echoing messages back to the client")
+	if len(records) != 1 || records[0][slog.LevelKey] != slog.LevelWarn.String() {
+		t.Errorf("got records %v, want a single warning", records)
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{Logger: discardLogger(), ListenerAddrFunc: tcpserver.NoopListenerAddrFunc})
+
+	if err := server.Serve(); !errors.Is(err, tcpserver.ErrNoHandler) {
+		t.Errorf("got error %v, want %v", err, tcpserver.ErrNoHandler)
+	}
+}
+
+func TestConcurrentShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var finished atomic.Bool
+	server, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+			<-release
+			finished.Store(true)
+			return message, nil
+		},
+	})
+
+	dial(t, addr).send("hello\n")
+	<-started
+
+	returned := make(chan bool, 3)
+	for range 3 {
+		go func() {
+			server.Shutdown()
+			returned <- finished.Load()
+		}()
+	}
+
+	select {
+	case <-returned:
+		t.Fatal("Shutdown returned while a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	for range 3 {
+		select {
+		case ok := <-returned:
+			if !ok {
+				t.Error("Shutdown returned before the handler finished")
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("Shutdown did not return")
+		}
+	}
+}
+
+func TestCloseDoesNotWaitForHandlers(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			close(started)
+			<-release
+			return message, nil
+		},
+	})
+	defer close(release)
+
+	conn := dial(t, addr)
+	conn.send("hello\n")
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("Close waited for the hung handler")
+	}
+
+	conn.expectClosed()
+}
+
+func TestShutdownInterruptsBlockedDecode(t *testing.T) {
+	disconnected := make(chan struct{})
+	server, addr := startServer(t, tcpserver.Config{
+		OnDisconnect: func(addr net.Addr, err error) {
+			close(disconnected)
+		},
+	})
+
+	// The decoder is blocked in the middle of a message.
+	conn := dial(t, addr)
+	conn.send("hel")
+	waitActiveConnections(t, server, 1)
+
+	start := time.Now()
+	server.Shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v with a blocked decode", elapsed)
+	}
+
+	select {
+	case <-disconnected:
+	default:
+		t.Error("the connection was not closed when Shutdown returned")
+	}
+}
+
+func TestOnServeAndOnShutdown(t *testing.T) {
+	var serves, shutdowns atomic.Int64
+	server := tcpserver.New(tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+		OnServe: func(addr net.Addr) {
+			serves.Add(1)
+		},
+		OnShutdown: func() {
+			shutdowns.Add(1)
+		},
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	<-server.Ready()
+	if got := serves.Load(); got != 1 {
+		t.Errorf("OnServe was called %d times once ready, want 1", got)
+	}
+
+	if got := shutdowns.Load(); got != 0 {
+		t.Errorf("OnShutdown was called %d times while serving, want 0", got)
+	}
+
+	server.Shutdown()
+	if got := shutdowns.Load(); got != 1 {
+		t.Errorf("OnShutdown was called %d times once Shutdown returned, want 1", got)
+	}
+
+	server.Shutdown()
+	if err := <-errCh; err != nil {
+		t.Errorf("server stopped with error: %v", err)
+	}
+
+	if got := shutdowns.Load(); got != 1 {
+		t.Errorf("OnShutdown was called %d times after a second Shutdown, want 1", got)
+	}
+
+	if got := serves.Load(); got != 1 {
+		t.Errorf("OnServe was called %d times, want 1", got)
+	}
+}
+
+func TestCloseFuncCalledOncePerConnection(t *testing.T) {
+	var closes atomic.Int64
+	server, addr := startServer(t, tcpserver.Config{
+		CloseFunc: func(conn net.Conn) error {
+			closes.Add(1)
+			return conn.Close()
+		},
+	})
+
+	for range 2 {
+		conn := dial(t, addr)
+		conn.roundTrip("hello")
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close connection: %v", err)
+		}
+	}
+
+	// The last connection is still open when the server is shut down.
+	dial(t, addr).roundTrip("hello")
+	server.Shutdown()
+
+	if got := closes.Load(); got != 3 {
+		t.Errorf("CloseFunc was called %d times, want 3", got)
+	}
+}
+
+func TestAcceptBacksOffOnFileDescriptorExhaustion(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+
+	recorder, logger := newLogRecorder()
+	_, addr := startServer(t, tcpserver.Config{
+		Logger:   logger,
+		Listener: newFailingListener(t, emfile, emfile, emfile),
+	})
+
+	if got := dial(t, addr).roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+
+	records := recorder.waitRecords(t, "failed to accept connection, retrying", 3)
+
+	var previous time.Duration
+	for _, record := range records {
+		// The JSON handler logs durations in nanoseconds.
+		delay := time.Duration(record["delay"].(float64))
+		if delay <= previous {
+			t.Errorf("got delay %v after %v, want an increasing delay", delay, previous)
+		}
+
+		previous = delay
+	}
+}
+
+func TestErrorEncoder(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			if string(message) == "fail\n" {
+				return nil, errors.New("invalid command")
+			}
+
+			return message, nil
+		},
+		ErrorEncoder: func(ctx context.Context, err error) []byte {
+			return []byte("ERR " + err.Error() + "\n")
+		},
+	})
+
+	conn := dial(t, addr)
+	if got, want := conn.roundTrip("fail"), "ERR invalid command"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q after an error, want %q", got, "hello")
+	}
+}
+
+func TestMaxAcceptCount(t *testing.T) {
+	server := tcpserver.New(tcpserver.Config{
+		Address:             "127.0.0.1:0",
+		MaxAcceptCount:      2,
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	<-server.Ready()
+	addr := server.Addr().String()
+
+	first, second := dial(t, addr), dial(t, addr)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return once the connections were accepted")
+	}
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Error("a third connection was accepted")
+	}
+
+	// The accepted connections keep being served.
+	for _, conn := range []*testConn{first, second} {
+		if got := conn.roundTrip("hello"); got != "hello" {
+			t.Errorf("got %q, want %q", got, "hello")
+		}
+
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close connection: %v", err)
+		}
+	}
+
+	waitNoConnections(t, server)
+}
+
+func TestOnError(t *testing.T) {
+	errHandler := errors.New("handler failed")
+
+	tests := []struct {
+		stage   string
+		cfg     tcpserver.Config
+		message string
+		want    error
+	}{
+		{
+			stage:   "decode",
+			cfg:     tcpserver.Config{MaxMessageSize: 8},
+			message: "far too long\n",
+			want:    tcpserver.ErrMessageTooLarge,
+		},
+		{
+			stage: "handle",
+			cfg: tcpserver.Config{Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+				return nil, errHandler
+			}},
+			message: "hello\n",
+			want:    errHandler,
+		},
+		{
+			stage:   "encode",
+			cfg:     tcpserver.Config{Encoder: &failingEncoder{failAt: 1}},
+			message: "hello\n",
+			want:    errEncode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stage, func(t *testing.T) {
+			type report struct {
+				stage string
+				err   error
+			}
+
+			reports := make(chan report, 1)
+			tt.cfg.OnError = func(addr net.Addr, stage string, err error) {
+				reports <- report{stage: stage, err: err}
+			}
+
+			_, addr := startServer(t, tt.cfg)
+
+			conn := dial(t, addr)
+			conn.send(tt.message)
+			conn.expectClosed()
+
+			r := <-reports
+			if r.stage != tt.stage {
+				t.Errorf("got stage %q, want %q", r.stage, tt.stage)
+			}
+
+			if !errors.Is(r.err, tt.want) {
+				t.Errorf("got error %v, want %v", r.err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParentContextCancellation(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := tcpserver.NewWithContext(parent, tcpserver.Config{
+		Logger:              discardLogger(),
+		ListenerAddrFunc:    tcpserver.NoopListenerAddrFunc,
+		AllowDefaultHandler: true,
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	<-server.Ready()
+	conn := dial(t, server.Addr().String())
+	conn.roundTrip("hello")
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("server stopped with error: %v", err)
+		}
+	case <-time.After(testTimeout):
+		server.Shutdown()
+		t.Fatal("the server did not stop once the parent context was canceled")
+	}
+
+	conn.expectClosed()
+}
+
+func TestConnFilterRejectsConnection(t *testing.T) {
+	var served atomic.Bool
+	_, addr := startServer(t, tcpserver.Config{
+		ConnFilter: func(remote net.Addr) bool {
+			ip, ok := remote.(*net.TCPAddr)
+			return !ok || !ip.IP.IsLoopback()
+		},
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			served.Store(true)
+			return message, nil
+		},
+	})
+
+	conn := dial(t, addr)
+	conn.send("hello\n")
+	conn.expectClosed()
+
+	if served.Load() {
+		t.Error("the Handler was invoked for a rejected connection")
+	}
+}
+
+func TestTimeoutResponse(t *testing.T) {
+	disconnected := make(chan error, 1)
+	_, addr := startServer(t, tcpserver.Config{
+		HandlerTimeout:  50 * time.Millisecond,
+		TimeoutResponse: []byte("TIMEOUT\n"),
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			time.Sleep(500 * time.Millisecond)
+			return []byte("too late\n"), nil
+		},
+		OnDisconnect: func(addr net.Addr, err error) {
+			disconnected <- err
+		},
+	})
+
+	conn := dial(t, addr)
+	start := time.Now()
+	if got := conn.roundTrip("hello"); got != "TIMEOUT" {
+		t.Errorf("got %q, want %q", got, "TIMEOUT")
+	}
+
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("got the timeout response after %v, want it before the handler returns", elapsed)
+	}
+
+	conn.expectClosed()
+
+	if err := <-disconnected; !errors.Is(err, tcpserver.ErrHandlerTimeout) {
+		t.Errorf("got disconnect error %v, want %v", err, tcpserver.ErrHandlerTimeout)
+	}
+}
+
+func TestReadBufferSizeLargeMessage(t *testing.T) {
+	message := bytes.Repeat([]byte("0123456789"), 1<<15)
+
+	for _, size := range []int{0, 16, 1 << 20} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			_, addr := startServer(t, tcpserver.Config{
+				ReadBufferSize: size,
+				Handler: func(ctx context.Context, m []byte) ([]byte, error) {
+					return []byte(fmt.Sprintf("%08x\n", crc32.ChecksumIEEE(m))), nil
+				},
+			})
+
+			want := fmt.Sprintf("%08x", crc32.ChecksumIEEE(append(message, '\n')))
+			conn := dial(t, addr)
+			for range 2 {
+				if got := conn.roundTrip(string(message)); got != want {
+					t.Errorf("got checksum %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+// readCountingListener counts the reads of the connections it accepts.
+type readCountingListener struct {
+	net.Listener
+	reads atomic.Int64
+}
+
+func (l *readCountingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &readCountingConn{Conn: conn, reads: &l.reads}, nil
+}
+
+type readCountingConn struct {
+	net.Conn
+	reads *atomic.Int64
+}
+
+func (c *readCountingConn) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.Conn.Read(p)
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	message := append(bytes.Repeat([]byte("x"), 64<<10), '\n')
+
+	for _, size := range []int{0, 16 << 10, 128 << 10} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("failed to listen: %v", err)
+			}
+
+			listener := &readCountingListener{Listener: inner}
+			_, addr := startServer(b, tcpserver.Config{
+				Listener:       listener,
+				ReadBufferSize: size,
+				Handler: func(ctx context.Context, m []byte) ([]byte, error) {
+					return []byte("ok\n"), nil
+				},
+			})
+
+			conn := dial(b, addr)
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				b.Fatalf("failed to clear deadline: %v", err)
+			}
+
+			b.SetBytes(int64(len(message)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := conn.Write(message); err != nil {
+					b.Fatalf("failed to write: %v", err)
+				}
+
+				conn.readLine()
+			}
+
+			b.ReportMetric(float64(listener.reads.Load())/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestOnListenErrorAbortsServe(t *testing.T) {
+	errRegister := errors.New("failed to register")
+
+	var listened net.Addr
+	var served atomic.Int64
+	server := tcpserver.New(tcpserver.Config{
+		Address:             "127.0.0.1:0",
+		Logger:              discardLogger(),
+		AllowDefaultHandler: true,
+		OnListen: func(addr net.Addr) error {
+			listened = addr
+			return errRegister
+		},
+		ListenerAddrFunc: func(addr net.Addr) {
+			served.Add(1)
+		},
+		OnServe: func(addr net.Addr) {
+			served.Add(1)
+		},
+	})
+
+	if err := server.Serve(); !errors.Is(err, errRegister) {
+		t.Fatalf("got error %v, want %v", err, errRegister)
+	}
+
+	if got := served.Load(); got != 0 {
+		t.Errorf("ListenerAddrFunc and OnServe were called %d times, want 0", got)
+	}
+
+	// The listener is closed, so its address can be bound again.
+	listener, err := net.Listen("tcp", listened.String())
+	if err != nil {
+		t.Fatalf("the listener was not closed: %v", err)
+	}
+	_ = listener.Close()
+}
@@ -0,0 +1,83 @@
+package tcpservertest_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+	"github.com/emacampolo/tcpserver/tcpservertest"
+)
+
+func ExampleRunServer() {
+	var t *testing.T // The *testing.T of the running test.
+
+	addr, _ := tcpservertest.RunServer(t, tcpserver.Config{})
+
+	client, err := tcpserver.Dial(addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Send([]byte("hello\n"))
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if string(response) != "hello\n" {
+		t.Errorf("got %q, want the message echoed back", response)
+	}
+}
+
+func ExampleRunServer_tableDriven() {
+	var t *testing.T // The *testing.T of the running test.
+
+	upper := func(ctx context.Context, message []byte) ([]byte, error) {
+		return bytes.ToUpper(message), nil
+	}
+
+	tests := []struct {
+		name    string
+		handler tcpserver.Handler
+		want    string
+	}{
+		{name: "echo", want: "hello\n"},
+		{name: "upper", handler: upper, want: "HELLO\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := tcpservertest.RunServer(t, tcpserver.Config{Handler: tt.handler})
+
+			client, err := tcpserver.Dial(addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer client.Close()
+
+			response, err := client.Send([]byte("hello\n"))
+			if err != nil {
+				t.Fatalf("failed to send: %v", err)
+			}
+
+			if string(response) != tt.want {
+				t.Errorf("got %q, want %q", response, tt.want)
+			}
+		})
+	}
+}
+
+func ExampleRunServer_shutdown() {
+	var t *testing.T // The *testing.T of the running test.
+
+	addr, shutdown := tcpservertest.RunServer(t, tcpserver.Config{})
+
+	// Stop the server before the test finishes, for instance to test how the code under test
+	// handles a server going away.
+	shutdown()
+
+	if _, err := tcpserver.Dial(addr); err == nil {
+		t.Error("expected the server to be stopped")
+	}
+}
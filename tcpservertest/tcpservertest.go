@@ -0,0 +1,65 @@
+// Package tcpservertest provides utilities for testing code that talks to a tcpserver.Server.
+package tcpservertest
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// startTimeout bounds how long RunServer waits for the server to listen.
+const startTimeout = 5 * time.Second
+
+// RunServer starts a server with cfg, waits until it is listening and returns the address to dial
+// and a function that shuts it down. The server is also shut down when the test finishes,
+// so calling the returned function is only needed to stop it earlier.
+//
+// Unless cfg sets them, the server logs nothing and the default echo Handler is allowed.
+// If the server fails to start or stops with an error, the test fails.
+func RunServer(t testing.TB, cfg tcpserver.Config) (addr string, shutdown func()) {
+	t.Helper()
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	if cfg.ListenerAddrFunc == nil {
+		cfg.ListenerAddrFunc = tcpserver.NoopListenerAddrFunc
+	}
+
+	if cfg.Handler == nil {
+		cfg.AllowDefaultHandler = true
+	}
+
+	server := tcpserver.New(cfg)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve()
+	}()
+
+	select {
+	case <-server.Ready():
+	case err := <-errCh:
+		t.Fatalf("tcpservertest: failed to start server: %v", err)
+	case <-time.After(startTimeout):
+		t.Fatalf("tcpservertest: server did not start within %s", startTimeout)
+	}
+
+	var once sync.Once
+	shutdown = func() {
+		once.Do(func() {
+			server.Shutdown()
+			if err := <-errCh; err != nil {
+				t.Errorf("tcpservertest: server stopped with error: %v", err)
+			}
+		})
+	}
+	t.Cleanup(shutdown)
+
+	return server.Addr().String(), shutdown
+}
@@ -0,0 +1,34 @@
+package tcpservertest_test
+
+import (
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+	"github.com/emacampolo/tcpserver/tcpservertest"
+)
+
+func TestRunServer(t *testing.T) {
+	addr, shutdown := tcpservertest.RunServer(t, tcpserver.Config{})
+
+	client, err := tcpserver.Dial(addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Send([]byte("hello\n"))
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	if string(response) != "hello\n" {
+		t.Errorf("got %q, want %q", response, "hello\n")
+	}
+
+	// Shutting down early is safe, the cleanup does not shut down the server again.
+	shutdown()
+
+	if _, err := tcpserver.Dial(addr); err == nil {
+		t.Error("expected the server to be stopped")
+	}
+}
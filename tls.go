@@ -0,0 +1,47 @@
+package tcpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// startTLS performs the server side TLS handshake on conn, as configured by TLSConfig or requested with StartTLS.
+// The bytes already buffered by r are read ahead of the connection, so none of the handshake is lost.
+func (s *Server) startTLS(ctx context.Context, conn net.Conn, r *bufio.Reader, config *tls.Config) (*tls.Conn, *tls.ConnectionState, error) {
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, reader: r}, config)
+	state, err := s.handshake(ctx, tlsConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tlsConn, state, nil
+}
+
+// handshake performs the TLS handshake, bounded by the ReadTimeout if set,
+// and returns the resulting connection state.
+func (s *Server) handshake(ctx context.Context, conn *tls.Conn) (*tls.ConnectionState, error) {
+	if s.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.readTimeout)
+		defer cancel()
+	}
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+	return &state, nil
+}
+
+// bufferedConn is a net.Conn that reads through the reader wrapping it.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,96 @@
+package tcpserver_test
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestTLS(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{TLSConfig: serverConfig})
+
+	conn := dial(t, addr).upgradeTLS(clientConfig)
+	if got := conn.roundTrip("hello"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestTLSHandshakeFailureClosesConnection(t *testing.T) {
+	serverConfig, _ := newTLSConfigs(t)
+	_, addr := startServer(t, tcpserver.Config{TLSConfig: serverConfig})
+
+	conn := dial(t, addr)
+	conn.send("hello\n")
+	conn.expectClosed()
+}
+
+func TestClientCert(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	clientCert, clientPool := newCertificate(t, "client-1")
+
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	serverConfig.ClientCAs = clientPool
+	clientConfig.Certificates = []tls.Certificate{clientCert}
+
+	_, addr := startServer(t, tcpserver.Config{
+		TLSConfig: serverConfig,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			cert := tcpserver.ClientCert(ctx)
+			if cert == nil {
+				return []byte("no certificate\n"), nil
+			}
+
+			return []byte(cert.Subject.CommonName + "\n"), nil
+		},
+	})
+
+	conn := dial(t, addr).upgradeTLS(clientConfig)
+	if got := conn.roundTrip("hello"); got != "client-1" {
+		t.Errorf("got %q, want %q", got, "client-1")
+	}
+}
+
+func TestTLSState(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	recorder, logger := newLogRecorder()
+
+	handler := func(ctx context.Context, message []byte) ([]byte, error) {
+		state := tcpserver.TLSState(ctx)
+		if state == nil {
+			return []byte("plaintext\n"), nil
+		}
+
+		return []byte(tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite) + "\n"), nil
+	}
+
+	_, plainAddr := startServer(t, tcpserver.Config{Handler: handler})
+	if got := dial(t, plainAddr).roundTrip("hello"); got != "plaintext" {
+		t.Errorf("got %q without TLS, want %q", got, "plaintext")
+	}
+
+	_, addr := startServer(t, tcpserver.Config{TLSConfig: serverConfig, Logger: logger, Handler: handler})
+
+	conn := dial(t, addr).upgradeTLS(clientConfig)
+	state := conn.Conn.(*tls.Conn).ConnectionState()
+	version, cipherSuite := tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+
+	if got, want := conn.roundTrip("hello"), version+" "+cipherSuite; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	records := recorder.records(t, "TLS handshake completed")
+	if len(records) != 1 {
+		t.Fatalf("got %d handshake records, want 1", len(records))
+	}
+
+	if got := records[0]["tls_version"]; got != version {
+		t.Errorf("got logged version %v, want %q", got, version)
+	}
+
+	if got := records[0]["cipher_suite"]; got != cipherSuite {
+		t.Errorf("got logged cipher suite %v, want %q", got, cipherSuite)
+	}
+}
@@ -0,0 +1,307 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrInvalidWebSocketHandshake is returned when a connection does not start with a valid WebSocket upgrade request.
+	ErrInvalidWebSocketHandshake = errors.New("invalid WebSocket handshake")
+
+	// ErrInvalidWebSocketFrame is returned when a WebSocket frame violates the protocol.
+	ErrInvalidWebSocketFrame = errors.New("invalid WebSocket frame")
+)
+
+// webSocketGUID is appended to the client key to compute the accept key, as defined by RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	// wsMaxControlPayload is the maximum payload length of a control frame.
+	wsMaxControlPayload = 125
+)
+
+// upgradeWebSocket reads the HTTP upgrade request from r, bounded by the ReadTimeout if set,
+// and answers it with the switching protocols response.
+// The returned webSocket decodes and encodes the messages of the connection.
+func (s *Server) upgradeWebSocket(conn net.Conn, r *bufio.Reader) (*webSocket, error) {
+	if s.readTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidWebSocketHandshake, err)
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.Method != http.MethodGet:
+		err = fmt.Errorf("%w: unexpected method %q", ErrInvalidWebSocketHandshake, req.Method)
+	case !headerContains(req.Header, "Connection", "upgrade"):
+		err = fmt.Errorf("%w: missing Connection upgrade", ErrInvalidWebSocketHandshake)
+	case !headerContains(req.Header, "Upgrade", "websocket"):
+		err = fmt.Errorf("%w: missing Upgrade websocket", ErrInvalidWebSocketHandshake)
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		err = fmt.Errorf("%w: unsupported version %q", ErrInvalidWebSocketHandshake, req.Header.Get("Sec-WebSocket-Version"))
+	case key == "":
+		err = fmt.Errorf("%w: missing Sec-WebSocket-Key", ErrInvalidWebSocketHandshake)
+	}
+
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, err
+	}
+
+	if s.writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		return nil, err
+	}
+
+	if s.writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &webSocket{maxSize: s.maxMessageSize}, nil
+}
+
+// headerContains reports whether the comma separated values of the header contain token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for the client key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// webSocket decodes each WebSocket message of a connection as one message and encodes each response as a single frame.
+// Ping frames are answered with a pong and a close frame is answered with a close frame before reporting io.EOF.
+type webSocket struct {
+	maxSize int
+
+	// writer is the ResponseWriter of the connection, through which the control frames are written
+	// so they are ordered with the responses and go through the same buffering and compression.
+	writer io.ReaderFrom
+
+	// opcode is the opcode of the last message received, used to send responses with the same type.
+	opcode atomic.Uint32
+}
+
+func (ws *webSocket) Decode(r io.Reader) ([]byte, error) {
+	var (
+		message []byte
+		opcode  byte
+	)
+
+	for {
+		fin, op, payload, err := ws.readFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) && opcode != wsOpContinuation {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := ws.writeControl(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code, if any, and let the connection end cleanly.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+
+			if err := ws.writeControl(wsOpClose, payload); err != nil {
+				return nil, err
+			}
+
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if opcode != wsOpContinuation {
+				return nil, fmt.Errorf("%w: new message before the previous one was completed", ErrInvalidWebSocketFrame)
+			}
+
+			opcode = op
+		case wsOpContinuation:
+			if opcode == wsOpContinuation {
+				return nil, fmt.Errorf("%w: unexpected continuation frame", ErrInvalidWebSocketFrame)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %#x", ErrInvalidWebSocketFrame, op)
+		}
+
+		if ws.maxSize > 0 && len(message)+len(payload) > ws.maxSize {
+			return nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, ws.maxSize)
+		}
+
+		message = append(message, payload...)
+		if fin {
+			ws.opcode.Store(uint32(opcode))
+			if message == nil {
+				message = []byte{}
+			}
+
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from r and returns its unmasked payload.
+func (ws *webSocket) readFrame(r io.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", ErrInvalidWebSocketFrame)
+	}
+
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("%w: client frame is not masked", ErrInvalidWebSocketFrame)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, unexpectedEOF(err)
+		}
+
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, unexpectedEOF(err)
+		}
+
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// The most significant bit of a 64-bit length must be 0.
+	if length > math.MaxInt64 {
+		return false, 0, nil, fmt.Errorf("%w: invalid payload length", ErrInvalidWebSocketFrame)
+	}
+
+	if opcode >= wsOpClose && (!fin || length > wsMaxControlPayload) {
+		return false, 0, nil, fmt.Errorf("%w: fragmented or oversized control frame", ErrInvalidWebSocketFrame)
+	}
+
+	if ws.maxSize > 0 && length > uint64(ws.maxSize) {
+		return false, 0, nil, fmt.Errorf("%w: exceeds the maximum of %d bytes", ErrMessageTooLarge, ws.maxSize)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return false, 0, nil, unexpectedEOF(err)
+	}
+
+	// The payload is read as it arrives rather than allocated upfront, since the length comes from the client.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		return false, 0, nil, unexpectedEOF(err)
+	}
+
+	payload = buf.Bytes()
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, as it is returned in the middle of a frame.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Encode writes p as a single unmasked frame with the type of the last message received, binary by default.
+func (ws *webSocket) Encode(w io.Writer, p []byte) error {
+	opcode := byte(ws.opcode.Load())
+	if opcode == wsOpContinuation {
+		opcode = wsOpBinary
+	}
+
+	_, err := w.Write(appendFrame(nil, opcode, p))
+	return err
+}
+
+// writeControl writes a control frame through the ResponseWriter of the connection, after any queued response.
+func (ws *webSocket) writeControl(opcode byte, payload []byte) error {
+	_, err := ws.writer.ReadFrom(bytes.NewReader(appendFrame(nil, opcode, payload)))
+	return err
+}
+
+// appendFrame appends a final, unmasked frame carrying payload to b.
+func appendFrame(b []byte, opcode byte, payload []byte) []byte {
+	b = append(b, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	return append(b, payload...)
+}
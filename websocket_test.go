@@ -0,0 +1,174 @@
+package tcpserver_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+func TestWebSocketEcho(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{
+		WebSocket: true,
+		Handler: func(ctx context.Context, message []byte) ([]byte, error) {
+			return append([]byte("echo: "), message...), nil
+		},
+	})
+
+	ws, err := websocket.Dial("ws://"+addr+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	for _, message := range []string{"hello", "world"} {
+		if err := websocket.Message.Send(ws, message); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+
+		var response string
+		if err := websocket.Message.Receive(ws, &response); err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+
+		if want := "echo: " + message; response != want {
+			t.Errorf("got %q, want %q", response, want)
+		}
+	}
+
+	binaryMessage := []byte{0x00, 0xff, '\n'}
+	if err := websocket.Message.Send(ws, binaryMessage); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	var response []byte
+	if err := websocket.Message.Receive(ws, &response); err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+
+	if want := "echo: " + string(binaryMessage); string(response) != want {
+		t.Errorf("got %q, want %q", response, want)
+	}
+}
+
+func TestWebSocketRejectsInvalidPayloadLength(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{WebSocket: true})
+
+	// A length with the most significant bit set is invalid.
+	conn := dialWebSocket(t, addr)
+	header := []byte{0x82, 0x80 | 127}
+	header = binary.BigEndian.AppendUint64(header, 1<<63)
+	conn.send(string(header) + "mask")
+	conn.expectClosed()
+
+	// A huge length must not be allocated before the payload arrives.
+	conn = dialWebSocket(t, addr)
+	header = []byte{0x82, 0x80 | 127}
+	header = binary.BigEndian.AppendUint64(header, 1<<40)
+	conn.send(string(header) + "mask" + "partial payload")
+	conn.closeWrite()
+	conn.expectClosed()
+
+	// The server keeps serving.
+	conn = dialWebSocket(t, addr)
+	conn.send(string(clientFrame(0x1, []byte("ping"))))
+	if opcode, payload := readServerFrame(t, conn.reader); opcode != 0x1 || string(payload) != "ping" {
+		t.Errorf("got frame %#x %q, want a text frame %q", opcode, payload, "ping")
+	}
+}
+
+func TestWebSocketControlFramesAreCompressed(t *testing.T) {
+	_, addr := startServer(t, tcpserver.Config{WebSocket: true, Compression: tcpserver.CompressionGzip})
+
+	conn := dialWebSocket(t, addr)
+
+	zw := gzip.NewWriter(conn)
+	write := func(frame []byte) {
+		t.Helper()
+
+		if _, err := zw.Write(frame); err != nil {
+			t.Fatalf("failed to write frame: %v", err)
+		}
+
+		if err := zw.Flush(); err != nil {
+			t.Fatalf("failed to flush frame: %v", err)
+		}
+	}
+
+	write(clientFrame(0x9, []byte("are you there")))
+	write(clientFrame(0x1, []byte("hello")))
+
+	zr, err := gzip.NewReader(conn.reader)
+	if err != nil {
+		t.Fatalf("failed to read the compressed stream: %v", err)
+	}
+
+	r := bufio.NewReader(zr)
+	if opcode, payload := readServerFrame(t, r); opcode != 0xa || string(payload) != "are you there" {
+		t.Errorf("got frame %#x %q, want a pong %q", opcode, payload, "are you there")
+	}
+
+	if opcode, payload := readServerFrame(t, r); opcode != 0x1 || string(payload) != "hello" {
+		t.Errorf("got frame %#x %q, want a text frame %q", opcode, payload, "hello")
+	}
+}
+
+// dialWebSocket connects to addr and completes the WebSocket upgrade handshake.
+func dialWebSocket(t *testing.T, addr string) *testConn {
+	t.Helper()
+
+	conn := dial(t, addr)
+	conn.send("GET / HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	resp, err := http.ReadResponse(conn.reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read the handshake response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	return conn
+}
+
+// clientFrame returns a final, masked frame carrying payload.
+func clientFrame(opcode byte, payload []byte) []byte {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+// readServerFrame reads an unmasked frame of less than 126 bytes.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("failed to read frame header: %v", err)
+	}
+
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("failed to read frame payload: %v", err)
+	}
+
+	return header[0] & 0x0f, payload
+}
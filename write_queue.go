@@ -0,0 +1,88 @@
+package tcpserver
+
+import "errors"
+
+// ErrWriteQueueFull is the error returned by ResponseWriter.Write when the write queue is full
+// and the WriteQueuePolicy is WriteQueueClose.
+var ErrWriteQueueFull = errors.New("write queue is full")
+
+// WriteQueuePolicy is what a ResponseWriter does when the write queue of its connection is full.
+type WriteQueuePolicy int
+
+const (
+	// WriteQueueBlock blocks Write until there is room in the queue.
+	WriteQueueBlock WriteQueuePolicy = iota
+
+	// WriteQueueDropOldest discards the oldest queued response to make room for the new one.
+	WriteQueueDropOldest
+
+	// WriteQueueClose fails Write with ErrWriteQueueFull, which closes the connection.
+	WriteQueueClose
+)
+
+// enqueue queues p to be written by the writer goroutine, applying the WriteQueuePolicy when the queue is full.
+func (w *connResponseWriter) enqueue(p []byte) error {
+	select {
+	case <-w.failed:
+		return w.queueErr
+	default:
+	}
+
+	w.inflight.Add(1)
+	select {
+	case w.queue <- p:
+		return nil
+	default:
+	}
+
+	switch w.queuePolicy {
+	case WriteQueueDropOldest:
+		for {
+			select {
+			case w.queue <- p:
+				return nil
+			case <-w.queue:
+				w.inflight.Done()
+			}
+		}
+	case WriteQueueClose:
+		w.inflight.Done()
+		w.fail(ErrWriteQueueFull)
+		return ErrWriteQueueFull
+	default:
+		select {
+		case w.queue <- p:
+			return nil
+		case <-w.failed:
+			w.inflight.Done()
+			return w.queueErr
+		}
+	}
+}
+
+// drainQueue writes the queued responses until the queue is closed, flushing whenever it is empty.
+// Once a write fails, the remaining responses are discarded.
+func (w *connResponseWriter) drainQueue() {
+	defer close(w.drained)
+
+	for p := range w.queue {
+		err := w.write(p)
+		if err == nil && len(w.queue) == 0 {
+			err = w.flush()
+		}
+
+		if err != nil {
+			w.fail(err)
+		}
+
+		w.inflight.Done()
+	}
+}
+
+// fail records the first error of the write queue, which makes subsequent writes fail.
+func (w *connResponseWriter) fail(err error) {
+	w.failOnce.Do(func() {
+		w.queueErr = err
+		close(w.failed)
+	})
+}
@@ -0,0 +1,129 @@
+package tcpserver_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emacampolo/tcpserver"
+)
+
+// queuedFrames returns a StreamHandler that writes n numbered responses for each message
+// and reports the result of the writes on done. The tests serve it over a pipeListener, whose connections
+// are synchronous, so a client that does not read blocks the writer goroutine on the first response.
+func queuedFrames(n int, done chan<- error) tcpserver.StreamHandler {
+	write := frames(n)
+	return func(ctx context.Context, message []byte, w tcpserver.ResponseWriter) error {
+		err := write(ctx, message, w)
+		done <- err
+		return err
+	}
+}
+
+func TestWriteQueueBlock(t *testing.T) {
+	const n = 3
+
+	done := make(chan error, 1)
+	listener := newPipeListener()
+	startServer(t, tcpserver.Config{
+		Listener:         listener,
+		WriteQueueSize:   1,
+		WriteQueuePolicy: tcpserver.WriteQueueBlock,
+		StreamHandler:    queuedFrames(n, done),
+	})
+
+	conn := listener.dial(t)
+	conn.send("go\n")
+
+	select {
+	case err := <-done:
+		t.Fatalf("the handler returned %v before the client read the responses", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := range n {
+		if got, want := conn.readLine(), strconv.Itoa(i); got != want {
+			t.Fatalf("got frame %q, want %q", got, want)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("failed to write: %v", err)
+	}
+}
+
+func TestWriteQueueDropOldest(t *testing.T) {
+	const n = 10
+
+	done := make(chan error, 1)
+	listener := newPipeListener()
+	startServer(t, tcpserver.Config{
+		Listener:         listener,
+		WriteQueueSize:   1,
+		WriteQueuePolicy: tcpserver.WriteQueueDropOldest,
+		StreamHandler:    queuedFrames(n, done),
+	})
+
+	conn := listener.dial(t)
+	conn.send("go\n")
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the handler was blocked by a client that does not read")
+	}
+
+	// The response being written when the queue filled up is received, followed by the most recent one.
+	var received []int
+	for len(received) == 0 || received[len(received)-1] != n-1 {
+		i, err := strconv.Atoi(conn.readLine())
+		if err != nil {
+			t.Fatalf("got an invalid frame: %v", err)
+		}
+
+		if len(received) > 0 && i <= received[len(received)-1] {
+			t.Fatalf("got frame %d after %v", i, received)
+		}
+
+		received = append(received, i)
+	}
+
+	if len(received) > 2 {
+		t.Errorf("got frames %v, want the older ones dropped", received)
+	}
+}
+
+func TestWriteQueueClose(t *testing.T) {
+	const n = 10
+
+	done := make(chan error, 1)
+	listener := newPipeListener()
+	startServer(t, tcpserver.Config{
+		Listener:         listener,
+		WriteQueueSize:   1,
+		WriteQueuePolicy: tcpserver.WriteQueueClose,
+		StreamHandler:    queuedFrames(n, done),
+	})
+
+	conn := listener.dial(t)
+	conn.send("go\n")
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, tcpserver.ErrWriteQueueFull) {
+			t.Fatalf("got error %v, want %v", err, tcpserver.ErrWriteQueueFull)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the handler was blocked by a client that does not read")
+	}
+
+	if _, err := io.Copy(io.Discard, conn.reader); err != nil {
+		t.Errorf("the connection was not closed once the write queue was full: %v", err)
+	}
+}